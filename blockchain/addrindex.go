@@ -0,0 +1,295 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+//Address index, funding and spending events per public key hash plus the
+//unspent outputs of each, so queries only read the entries of one address.
+//Keys, all under addrIndexPrefix:
+//  h<block hash>                              -> height
+//  e<pkh><height><tx position><kind><n>       -> event
+//  u<pkh><txid><output index>                 -> value of an unspent output
+var (
+	addrIndexKey    = []byte("addrindex")
+	addrIndexPrefix = []byte("addr-")
+)
+
+const (
+	fundEvent  = byte(0)
+	spendEvent = byte(1)
+)
+
+//funding (an output paying the address) or spending (an input spending one)
+type AddressEvent struct {
+	Height    int
+	BlockHash []byte
+	TxID      []byte
+	//output index for funding, input index for spending
+	Index int
+	Value int
+	Spend bool
+	//outpoint spent by a spending event
+	PrevTxID  []byte
+	PrevIndex int
+}
+
+type addrIndex struct{}
+
+func (addrIndex) Name() string   { return "addrindex" }
+func (addrIndex) key() []byte    { return addrIndexKey }
+func (addrIndex) prefix() []byte { return addrIndexPrefix }
+
+func addrIndexEntry(kind byte, parts ...[]byte) []byte {
+	key := append(append([]byte{}, addrIndexPrefix...), kind)
+	for _, part := range parts {
+		key = append(key, part...)
+	}
+	return key
+}
+
+func uint32Key(v int) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(v))
+	return buf
+}
+
+func blockHeightEntry(hash []byte) []byte {
+	return addrIndexEntry('h', hash)
+}
+
+func eventEntry(pkh []byte, height, pos int, kind byte, n int) []byte {
+	return addrIndexEntry('e', pkh, uint32Key(height), uint32Key(pos), []byte{kind}, uint32Key(n))
+}
+
+func unspentEntry(pkh, txID []byte, index int) []byte {
+	return addrIndexEntry('u', pkh, txID, uint32Key(index))
+}
+
+func encodeEvent(event AddressEvent) []byte {
+	enc := encoder{}
+	enc.bytes(event.BlockHash)
+	enc.bytes(event.TxID)
+	enc.uvarint(uint64(event.Index))
+	enc.varint(int64(event.Value))
+	enc.bytes(event.PrevTxID)
+	enc.uvarint(uint64(event.PrevIndex))
+	return enc.buf.Bytes()
+}
+
+func decodeEvent(value []byte) (AddressEvent, error) {
+	var event AddressEvent
+	dec := newDecoder(value)
+	event.BlockHash = dec.bytes()
+	event.TxID = dec.bytes()
+	event.Index = int(dec.uvarint())
+	event.Value = int(dec.varint())
+	event.PrevTxID = dec.bytes()
+	event.PrevIndex = int(dec.uvarint())
+	event.Spend = event.PrevTxID != nil
+	return event, dec.finish()
+}
+
+func getInt(txn *badger.Txn, key []byte) (int, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	value, err := item.Value()
+	if err != nil {
+		return 0, err
+	}
+	dec := newDecoder(value)
+	v := int(dec.varint())
+	return v, dec.finish()
+}
+
+func setInt(txn *badger.Txn, key []byte, v int) error {
+	enc := encoder{}
+	enc.varint(int64(v))
+	return txn.Set(key, enc.buf.Bytes())
+}
+
+//address of the output spent by in, taken from the output itself rather
+//than hashed from the input's public key
+func spentPubKeyHash(spent map[string]TxOutput, in TxInput) ([]byte, error) {
+	out, ok := spent[outpointKey(in.ID, in.Out)]
+	if !ok {
+		return nil, fmt.Errorf("no spent output for %s", outpointKey(in.ID, in.Out))
+	}
+	return out.PubKeyHash, nil
+}
+
+func (addrIndex) connect(txn *badger.Txn, block *Block, spent map[string]TxOutput) error {
+	height := 0
+	if len(block.PrevHash) > 0 {
+		parent, err := getInt(txn, blockHeightEntry(block.PrevHash))
+		if err != nil {
+			return err
+		}
+		height = parent + 1
+	}
+	if err := setInt(txn, blockHeightEntry(block.Hash), height); err != nil {
+		return err
+	}
+
+	for pos, tx := range block.Transactions {
+		if !tx.IsCoinBase() {
+			for n, in := range tx.Inputs {
+				pkh, err := spentPubKeyHash(spent, in)
+				if err != nil {
+					return err
+				}
+				unspent := unspentEntry(pkh, in.ID, in.Out)
+				value, err := getInt(txn, unspent)
+				if err != nil {
+					return err
+				}
+				if err := txn.Delete(unspent); err != nil {
+					return err
+				}
+				event := AddressEvent{BlockHash: block.Hash, TxID: tx.ID, Index: n, Value: value, PrevTxID: in.ID, PrevIndex: in.Out}
+				if err := txn.Set(eventEntry(pkh, height, pos, spendEvent, n), encodeEvent(event)); err != nil {
+					return err
+				}
+			}
+		}
+		for n, out := range tx.Outputs {
+			if out.IsData() {
+				continue
+			}
+			if err := setInt(txn, unspentEntry(out.PubKeyHash, tx.ID, n), out.Value); err != nil {
+				return err
+			}
+			event := AddressEvent{BlockHash: block.Hash, TxID: tx.ID, Index: n, Value: out.Value}
+			if err := txn.Set(eventEntry(out.PubKeyHash, height, pos, fundEvent, n), encodeEvent(event)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (addrIndex) disconnect(txn *badger.Txn, block *Block, spent map[string]TxOutput) error {
+	height, err := getInt(txn, blockHeightEntry(block.Hash))
+	if err != nil {
+		return err
+	}
+
+	for pos := len(block.Transactions) - 1; pos >= 0; pos-- {
+		tx := block.Transactions[pos]
+		for n, out := range tx.Outputs {
+			if out.IsData() {
+				continue
+			}
+			if err := txn.Delete(unspentEntry(out.PubKeyHash, tx.ID, n)); err != nil {
+				return err
+			}
+			if err := txn.Delete(eventEntry(out.PubKeyHash, height, pos, fundEvent, n)); err != nil {
+				return err
+			}
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+		for n, in := range tx.Inputs {
+			pkh, err := spentPubKeyHash(spent, in)
+			if err != nil {
+				return err
+			}
+			key := eventEntry(pkh, height, pos, spendEvent, n)
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			value, err := item.Value()
+			if err != nil {
+				return err
+			}
+			event, err := decodeEvent(value)
+			if err != nil {
+				return err
+			}
+			if err := setInt(txn, unspentEntry(pkh, in.ID, in.Out), event.Value); err != nil {
+				return err
+			}
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return txn.Delete(blockHeightEntry(block.Hash))
+}
+
+//unspent outputs paying pubKeyHash
+func (chain *Blockchain) AddressUTXOs(pubKeyHash []byte) ([]UTXO, error) {
+	if !chain.HasIndex(addrIndex{}.Name()) {
+		return nil, ErrIndexDisabled
+	}
+	var utxos []UTXO
+	prefix := addrIndexEntry('u', pubKeyHash)
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)[len(prefix):]
+			value, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			dec := newDecoder(value)
+			amount := int(dec.varint())
+			if err := dec.finish(); err != nil {
+				return err
+			}
+			txID, index := key[:len(key)-4], binary.BigEndian.Uint32(key[len(key)-4:])
+			utxos = append(utxos, UTXO{txID, int(index), amount})
+		}
+		return nil
+	})
+	return utxos, err
+}
+
+func (chain *Blockchain) AddressBalance(pubKeyHash []byte) (int, error) {
+	utxos, err := chain.AddressUTXOs(pubKeyHash)
+	balance := 0
+	for _, utxo := range utxos {
+		balance += utxo.Value
+	}
+	return balance, err
+}
+
+//funding and spending events of pubKeyHash, oldest first
+func (chain *Blockchain) AddressHistory(pubKeyHash []byte) ([]AddressEvent, error) {
+	if !chain.HasIndex(addrIndex{}.Name()) {
+		return nil, ErrIndexDisabled
+	}
+	var events []AddressEvent
+	prefix := addrIndexEntry('e', pubKeyHash)
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)[len(prefix):]
+			value, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			event, err := decodeEvent(value)
+			if err != nil {
+				return err
+			}
+			event.Height = int(binary.BigEndian.Uint32(key[:4]))
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
@@ -2,39 +2,103 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"log"
 )
 
+//Block versions, they decide how transactions are hashed into the Merkle root
+const (
+	LegacyBlockVersion = 0 //transactions hashed with their gob encoding
+	BlockVersion       = 1 //transactions hashed with their canonical encoding
+)
+
 type Block struct {
 	Hash         []byte
 	Transactions []*Transaction
 	PrevHash     []byte
 	Nonce        int
+	Version      int
+	Seal         []byte //consensus specific proof, e.g. the signer's signature
+	MerkleRoot   []byte //kept when the transactions are pruned, nil otherwise
+}
+
+//only the header of a pruned block is stored
+func (block *Block) Pruned() bool {
+	return block.MerkleRoot != nil
 }
 
-//Provides unique representation of all transactions combined
+//Provides unique representation of all transactions combined, a pruned
+//block only has the root it kept while blocks carrying transactions are
+//always hashed from them
 func (block *Block) HashTransactions() []byte {
+	if block.Pruned() && len(block.Transactions) == 0 {
+		return block.MerkleRoot
+	}
+	tree := NewMerkleTree(block.merkleLeaves())
+	return tree.RootNode.Data
+}
+
+//Merkle proof that the transaction at index is part of the block
+func (block *Block) ProveTransaction(index int) (*MerkleProof, error) {
+	return NewMerkleProof(block.merkleLeaves(), index)
+}
+
+//check a Merkle proof for tx against the block's Merkle root
+func (block *Block) VerifyProof(tx *Transaction, proof *MerkleProof) bool {
+	return proof.Verify(block.merkleLeaf(tx), block.HashTransactions())
+}
+
+func (block *Block) merkleLeaves() [][]byte {
 	var txHashes [][]byte
 
 	for _, tx := range block.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+		txHashes = append(txHashes, block.merkleLeaf(tx))
 	}
-	tree := NewMerkleTree(txHashes)
-	return tree.RootNode.Data
+	return txHashes
+}
+
+func (block *Block) merkleLeaf(tx *Transaction) []byte {
+	if block.Version == LegacyBlockVersion {
+		return tx.legacySerialize()
+	}
+	return tx.Serialize()
+}
+
+//id tx must have, legacy blocks hashed transactions with their gob encoding
+func (block *Block) txID(tx *Transaction) []byte {
+	if block.Version == LegacyBlockVersion {
+		return tx.legacyUnsignedHash()
+	}
+	return tx.unsignedHash()
+}
+
+//check the signatures of tx given the outputs it spends, keyed by
+//outpointKey, legacy blocks hold r||s signatures over the old hash
+func (block *Block) verifySignatures(tx *Transaction, prevOuts map[string]TxOutput) bool {
+	if block.Version == LegacyBlockVersion {
+		return tx.verifyLegacyOutputs(prevOuts)
+	}
+	return tx.verifyOutputs(prevOuts)
 }
 
 //Create a new block
 func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
-	block := &Block{[]byte{}, txs, prevHash, 0}
-	pow := Proof(block)
-	nonce, hash := pow.Run()
-
-	block.Hash = hash[:]
-	block.Nonce = nonce
+	block, err := MineBlock(context.Background(), txs, prevHash)
+	Handle(err)
 	return block
 }
 
+//Create a new block, giving up when ctx is done (e.g. a new tip arrived)
+func MineBlock(ctx context.Context, txs []*Transaction, prevHash []byte) (*Block, error) {
+	block := &Block{[]byte{}, txs, prevHash, 0, BlockVersion, nil, nil}
+	err := PoWEngine{}.Seal(ctx, nil, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
 // Create Genesis Block (very first block)
 func GenesisBlock(coinbase *Transaction) *Block {
 	return CreateBlock([]*Transaction{coinbase}, []byte{})
@@ -44,24 +108,61 @@ func GenesisBlock(coinbase *Transaction) *Block {
 // @Params (Block struct)
 // @return ([]byte)
 func (block *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-
-	err := encoder.Encode(block)
-	Handle(err)
-	return res.Bytes()
+	enc := encoder{}
+	enc.uvarint(blockSerializationVersion)
+	enc.uvarint(uint64(block.Version))
+	enc.bytes(block.Hash)
+	enc.bytes(block.PrevHash)
+	enc.varint(int64(block.Nonce))
+	enc.uvarint(uint64(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		enc.transaction(tx)
+	}
+	enc.bytes(block.Seal)
+	enc.bytes(block.MerkleRoot)
+	return enc.buf.Bytes()
 }
 
 //Deserialze data from []byte to *Block
 //@Params ([]byte)
 //@return (*Block)
 func Deserialize(data []byte) *Block {
+	block, err := decodeBlock(data)
+	Handle(err)
+	return block
+}
+
+func decodeBlock(data []byte) (*Block, error) {
+	dec := newDecoder(data)
+	block := &Block{}
+
+	format := dec.version(blockSerializationVersion)
+	block.Version = int(dec.uvarint())
+	block.Hash = dec.bytes()
+	block.PrevHash = dec.bytes()
+	block.Nonce = int(dec.varint())
+	for n := dec.length(); n > 0 && dec.err == nil; n-- {
+		block.Transactions = append(block.Transactions, dec.transaction())
+	}
+	if format >= 2 {
+		block.Seal = dec.bytes()
+	}
+	if format >= 3 {
+		block.MerkleRoot = dec.bytes()
+	}
+	if err := dec.finish(); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+//Deserialize gob encoded blocks written by older versions
+func legacyDeserialize(data []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 
 	err := decoder.Decode(&block)
-	Handle(err)
-	return &block
+	return &block, err
 }
 
 //function to Handle error
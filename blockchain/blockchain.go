@@ -2,14 +2,19 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/shraddha0602/blockchain-implementation/wallet"
 )
 
 // Database Path
@@ -19,15 +24,59 @@ const (
 	genesisData = "First Transaction from Genesis"
 )
 
+//A Blockchain can be shared by goroutines. Readers go through the
+//database, which gives each transaction a consistent view, and the
+//accessors below. Writers, which connect and disconnect blocks or change
+//the settings, run one at a time.
 type Blockchain struct {
-	LastHash []byte
 	Database *badger.DB
+	Engine   ConsensusEngine
+
+	writer sync.Mutex //held while writing blocks, the UTXO set or indexes
+	//guards the fields below for readers, only writers change them
+	mu         sync.RWMutex
+	lastHash   []byte
+	indexes    []chainIndex //enabled optional indexes
+	pruneDepth int          //blocks kept with their transactions, 0 keeps all
+	//tip of the snapshot the chain was loaded from until it is backfilled
+	snapshotTip []byte
+	hashRate    float64 //of the last block sealed with proof of work
 }
 
 // To implement feature to iterate through blockchain and access each Block
+//It reads a snapshot of the database taken when it was created, blocks
+//added or pruned meanwhile don't change what it returns. Every iterator
+//must be closed with Close, the database keeps the snapshot until then.
 type BlockchainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	txn         *badger.Txn
+}
+
+//hash of the tip block
+func (chain *Blockchain) LastHash() []byte {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+	return chain.lastHash
+}
+
+func (chain *Blockchain) setTip(hash []byte) {
+	chain.mu.Lock()
+	chain.lastHash = hash
+	chain.mu.Unlock()
+}
+
+//hashes per second mining the last block sealed by this chain, 0 when its
+//engine doesn't mine
+func (chain *Blockchain) HashRate() float64 {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+	return chain.hashRate
+}
+
+func (chain *Blockchain) setHashRate(rate float64) {
+	chain.mu.Lock()
+	chain.hashRate = rate
+	chain.mu.Unlock()
 }
 
 //to check if database exists
@@ -38,61 +87,174 @@ func DBexists() bool {
 	return true
 }
 
-// Adds block to Blockchain
+// Adds block to Blockchain and the UTXO set
 func (chain *Blockchain) AddBlock(txs []*Transaction) *Block {
-	var lastHash []byte
+	chain.writer.Lock()
+	defer chain.writer.Unlock()
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
+	newBlock, err := chain.sealBlock(txs, chain.LastHash())
+	Handle(err)
+
+	err = chain.storeBlock(newBlock)
+	Handle(err)
+	return newBlock
+}
+
+//write block as the new tip, updating the UTXO set and the indexes in the
+//same transaction so a crash can't leave them behind, then prune the
+//blocks that fell out of the prune window. The caller holds the writer lock.
+func (chain *Blockchain) storeBlock(block *Block) error {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		lastHash, err = item.Value()
-		return err
+		if err != nil {
+			return err
+		}
+		lastHash, err := item.Value()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(lastHash, block.PrevHash) {
+			return fmt.Errorf("block %x doesn't extend the tip %x", block.Hash, lastHash)
+		}
+
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("lh"), block.Hash); err != nil {
+			return err
+		}
+		if err := updateUTXO(txn, block); err != nil {
+			return err
+		}
+		return chain.connectIndexes(txn, block)
 	})
-	Handle(err)
-	newBlock := CreateBlock(txs, lastHash)
+	if err != nil {
+		return err
+	}
+	chain.setTip(block.Hash)
+	if chain.pruneDepth == 0 {
+		return nil
+	}
+	_, err = chain.pruneBlocks()
+	return err
+}
+
+//Remove the tip block from the chain, the UTXO set and the indexes in one
+//transaction. The block stays in the database.
+func (chain *Blockchain) DisconnectTip() (*Block, error) {
+	chain.writer.Lock()
+	defer chain.writer.Unlock()
+
+	block, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return nil, err
+	}
+	if len(block.PrevHash) == 0 {
+		return nil, errors.New("the genesis block can't be disconnected")
+	}
+	spent, err := (&UTXOSet{chain}).spentOutputs(block)
+	if err != nil {
+		return nil, err
+	}
 
 	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
-		chain.LastHash = newBlock.Hash
-		return err
+		if err := txn.Set([]byte("lh"), block.PrevHash); err != nil {
+			return err
+		}
+		if err := revertUTXO(txn, block, spent); err != nil {
+			return err
+		}
+		return chain.disconnectIndexes(txn, block, spent)
 	})
-	Handle(err)
-	return newBlock
+	if err != nil {
+		return nil, err
+	}
+	chain.setTip(block.PrevHash)
+	return block, nil
 }
 
-//Initialize Blockchain on start
-func InitBlockchain(address string) *Blockchain {
-	var lasthash []byte
+//build a block on top of prevHash and seal it with the chain's engine
+func (chain *Blockchain) sealBlock(txs []*Transaction, prevHash []byte) (*Block, error) {
+	block := &Block{[]byte{}, txs, prevHash, 0, BlockVersion, nil, nil}
+	if err := chain.Engine.Prepare(chain, block); err != nil {
+		return nil, err
+	}
+	chain.setHashRate(0)
+	if err := chain.Engine.Seal(context.Background(), chain, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
 
+//Initialize Blockchain on start
+func InitBlockchain(address string, engine ConsensusEngine) *Blockchain {
 	if DBexists() {
 		fmt.Println("Blockchain already exists")
 		runtime.Goexit()
 	}
 
-	opts := badger.DefaultOptions
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+	db, err := openDB()
+	Handle(err)
+	chain := &Blockchain{Database: db, Engine: engine}
 
-	db, err := badger.Open(opts)
+	cbtx := CoinbaseTx(address, genesisData)
+	genesis, err := chain.sealBlock([]*Transaction{cbtx}, []byte{})
 	Handle(err)
+	fmt.Println("Genesis created")
 
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := GenesisBlock(cbtx)
-		fmt.Println("Genesis created")
+	err = chain.storeGenesis(genesis)
+	Handle(err)
+	return chain
+}
+
+//how long opening the database waits for another process holding it,
+//e.g. a background backfill between two batches
+const dbLockWait = 10 * time.Second
+
+func openDB() (*badger.DB, error) {
+	return openDBAt(dbPath)
+}
+
+func openDBAt(dir string) (*badger.DB, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+
+	deadline := time.Now().Add(dbLockWait)
+	for {
+		db, err := badger.Open(opts)
+		if !dbLocked(err) || time.Now().After(deadline) {
+			return db, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
 
-		err = txn.Set(genesis.Hash, genesis.Serialize())
+//whether err is badger refusing a database another process has open
+func dbLocked(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Another process is using this Badger database")
+}
+
+//write the genesis block, its outputs and the settings of a new chain
+func (chain *Blockchain) storeGenesis(genesis *Block) error {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		err := txn.Set(genesis.Hash, genesis.Serialize())
 		Handle(err)
 		err = txn.Set([]byte("lh"), genesis.Hash)
-
-		lasthash = genesis.Hash
-		return err
+		Handle(err)
+		err = setInt(txn, schemaKey, SchemaVersion)
+		Handle(err)
+		err = txn.Set(utxoStatsKey, newUTXOStats().encode())
+		Handle(err)
+		err = updateUTXO(txn, genesis)
+		Handle(err)
+		return saveEngine(txn, chain.Engine)
 	})
-	Handle(err)
-	blockchain := Blockchain{lasthash, db}
-	return &blockchain
+	if err != nil {
+		return err
+	}
+	chain.setTip(genesis.Hash)
+	return nil
 }
 
 //if blockchain already exists
@@ -101,61 +263,148 @@ func ContinueBlockchain(address string) *Blockchain {
 		fmt.Println("No existsing database found, create one")
 		runtime.Goexit()
 	}
-	var lastHash []byte
-
-	opts := badger.DefaultOptions
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
-
-	db, err := badger.Open(opts)
+	chain, err := openChain()
 	Handle(err)
+	return chain
+}
+
+//open the existing database, migrating it and catching the UTXO set up
+func openChain() (*Blockchain, error) {
+	var lastHash []byte
+	var engine ConsensusEngine
+	var indexes []chainIndex
+	var pruneDepth int
+	var snapshot *SnapshotInfo
+
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = migrateDatabase(db, false); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	err = db.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		lastHash, err = item.Value()
+		if err != nil {
+			return err
+		}
+		if lastHash, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+		if engine, err = loadEngine(txn); err != nil {
+			return err
+		}
+		if indexes, err = loadIndexes(txn, lastHash); err != nil {
+			return err
+		}
+		if pruneDepth, err = loadPruneDepth(txn); err != nil {
+			return err
+		}
+		snapshot, err = loadSnapshotInfo(txn)
 		return err
 	})
-	Handle(err)
-	chain := Blockchain{lastHash, db}
-	return &chain
-
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	chain := &Blockchain{Database: db, Engine: engine, lastHash: lastHash, indexes: indexes, pruneDepth: pruneDepth}
+	if snapshot != nil {
+		chain.snapshotTip = snapshot.TipHash
+	}
+	if err := chain.repairUTXO(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return chain, nil
 }
 
-// function to convert Blockchain to BlockchainIterator
-func (chain *Blockchain) Iterator() *BlockchainIterator {
-	itr := &BlockchainIterator{chain.LastHash, chain.Database}
-	return itr
+//get a block by its hash, ErrBlockPruned when only its header is kept
+func (chain *Blockchain) GetBlock(hash []byte) (*Block, error) {
+	block, err := chain.getBlock(hash)
+	if err == nil && block.Pruned() {
+		return nil, fmt.Errorf("%w: %x", ErrBlockPruned, hash)
+	}
+	return block, err
 }
 
-//iterate backwords using previous Hash stored in db
-func (itr *BlockchainIterator) Next() *Block {
+//get a block or the header of a pruned block
+func (chain *Blockchain) getBlock(hash []byte) (*Block, error) {
 	var block *Block
 
-	err := itr.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(itr.CurrentHash)
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(hash)
+		if err != nil {
+			return err
+		}
 		encodedBlock, err := item.Value()
+		if err != nil {
+			return err
+		}
 		block = Deserialize(encodedBlock)
-		return err
+		return nil
 	})
+	return block, err
+}
+
+// function to convert Blockchain to BlockchainIterator, the caller closes it
+func (chain *Blockchain) Iterator() *BlockchainIterator {
+	txn := chain.Database.NewTransaction(false)
+	item, err := txn.Get([]byte("lh"))
+	Handle(err)
+	lastHash, err := item.ValueCopy(nil)
+	Handle(err)
+	itr := &BlockchainIterator{lastHash, txn}
+	return itr
+}
+
+//iterate backwords using previous Hash stored in db
+func (itr *BlockchainIterator) Next() *Block {
+	block, err := itr.next()
 	Handle(err)
-	itr.CurrentHash = block.PrevHash
 	return block
 }
 
-func (chain *Blockchain) FindUnspentTransactions() map[string]TxOutputs {
+func (itr *BlockchainIterator) next() (*Block, error) {
+	item, err := itr.txn.Get(itr.CurrentHash)
+	if err != nil {
+		return nil, err
+	}
+	encodedBlock, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+	block := Deserialize(encodedBlock)
+	itr.CurrentHash = block.PrevHash
+	return block, nil
+}
+
+//release the snapshot read by the iterator
+func (itr *BlockchainIterator) Close() {
+	itr.txn.Discard()
+}
+
+func (chain *Blockchain) FindUnspentTransactions() (map[string]TxOutputs, error) {
 	UTXO := make(map[string]TxOutputs)
 	spent := make(map[string][]int)
 
 	itr := chain.Iterator()
+	defer itr.Close()
 	for {
 		block := itr.Next()
+		if block.Pruned() {
+			return nil, fmt.Errorf("rebuilding the UTXO set needs every block: %w", ErrBlockPruned)
+		}
 
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs:
 			for outIdx, out := range tx.Outputs {
+				if out.IsData() {
+					continue
+				}
 				if spent[txID] != nil {
 					for _, spentOut := range spent[txID] {
 						if spentOut == outIdx {
@@ -164,7 +413,7 @@ func (chain *Blockchain) FindUnspentTransactions() map[string]TxOutputs {
 					}
 				}
 				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				outs.Add(outIdx, out)
 				UTXO[txID] = outs
 			}
 
@@ -180,15 +429,72 @@ func (chain *Blockchain) FindUnspentTransactions() map[string]TxOutputs {
 			break
 		}
 	}
-	return UTXO
+	return UTXO, nil
+}
+
+//public key hashes that received an output or signed an input anywhere
+//on the chain, keyed by hex
+func (chain *Blockchain) UsedPubKeyHashes() (map[string]bool, error) {
+	used := make(map[string]bool)
+
+	itr := chain.Iterator()
+	defer itr.Close()
+	for {
+		block := itr.Next()
+		if block.Pruned() {
+			return nil, fmt.Errorf("finding the used keys needs every block: %w", ErrBlockPruned)
+		}
+
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Outputs {
+				if !out.IsData() {
+					used[hex.EncodeToString(out.PubKeyHash)] = true
+				}
+			}
+			if tx.IsCoinBase() == false {
+				for _, in := range tx.Inputs {
+					used[hex.EncodeToString(wallet.PublicKeyHash(in.PubKey))] = true
+				}
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return used, nil
 }
 
-//finding transaction
+//finding transaction, through the tx index when it is enabled
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	if blockHash, pos, found, err := bc.LocateTransaction(ID); err != ErrIndexDisabled {
+		if err != nil {
+			return Transaction{}, err
+		}
+		if !found {
+			return Transaction{}, errors.New("Transaction doesn't exists!!")
+		}
+		block, err := bc.GetBlock(blockHash)
+		if errors.Is(err, ErrBlockPruned) {
+			return Transaction{}, fmt.Errorf("transaction %x is in a pruned block: %w", ID, ErrBlockPruned)
+		}
+		if err != nil {
+			return Transaction{}, err
+		}
+		if pos >= len(block.Transactions) {
+			return Transaction{}, errors.New("tx index points past the end of the block")
+		}
+		return *block.Transactions[pos], nil
+	}
+
 	itr := bc.Iterator()
+	defer itr.Close()
 
 	for {
 		block := itr.Next()
+		if block.Pruned() {
+			return Transaction{}, fmt.Errorf("transaction %x not found in the unpruned blocks, the tx index finds older ones: %w", ID, ErrBlockPruned)
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
@@ -203,17 +509,37 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New("Transaction doesn't exists!!")
 }
 
-//signing the transaction
-func (bc *Blockchain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
-	prevTransacs := make(map[string]Transaction)
+//find the block and transaction carrying data in a data output
+//along with the Merkle proof of the transaction's inclusion
+func (bc *Blockchain) FindData(data []byte) (*Block, *Transaction, *MerkleProof, error) {
+	itr := bc.Iterator()
+	defer itr.Close()
 
-	for _, in := range tx.Inputs {
-		prevTransac, err := bc.FindTransaction(in.ID)
-		Handle(err)
-		prevTransacs[hex.EncodeToString(prevTransac.ID)] = prevTransac
+	for {
+		block := itr.Next()
+		if block.Pruned() {
+			return nil, nil, nil, fmt.Errorf("data not found in the blocks kept, older ones are pruned: %w", ErrBlockPruned)
+		}
+
+		for idx, tx := range block.Transactions {
+			if tx.HasData(data) {
+				proof, err := block.ProveTransaction(idx)
+				return block, tx, proof, err
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
 	}
+	return nil, nil, nil, errors.New("Data not found in blockchain")
+}
 
-	tx.Sign(privateKey, prevTransacs)
+//signing the transaction
+func (bc *Blockchain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
+	prevOuts, err := bc.prevOutputs(tx)
+	Handle(err)
+	tx.signOutputs(privateKey, prevOuts, SigHashAll)
 }
 
 //verifying a transaction
@@ -223,12 +549,30 @@ func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 		return true
 	}
 
-	prevTransacs := make(map[string]Transaction)
+	prevOuts, err := bc.prevOutputs(tx)
+	Handle(err)
+	return tx.verifyOutputs(prevOuts)
+}
+
+//outputs spent by the inputs of tx keyed by outpointKey, from the UTXO set
+//or, for spent ones, their transactions
+func (bc *Blockchain) prevOutputs(tx *Transaction) (map[string]TxOutput, error) {
+	UTXO := UTXOSet{bc}
+	prevOuts := make(map[string]TxOutput)
 
 	for _, in := range tx.Inputs {
-		prevTransac, err := bc.FindTransaction(in.ID)
-		Handle(err)
-		prevTransacs[hex.EncodeToString(prevTransac.ID)] = prevTransac
+		out, found := UTXO.FindOutput(in.ID, in.Out)
+		if !found {
+			prevTx, err := bc.FindTransaction(in.ID)
+			if err != nil {
+				return nil, err
+			}
+			if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+				return nil, fmt.Errorf("transaction %x has no output %d", in.ID, in.Out)
+			}
+			out = prevTx.Outputs[in.Out]
+		}
+		prevOuts[outpointKey(in.ID, in.Out)] = out
 	}
-	return tx.Verify(prevTransacs)
+	return prevOuts, nil
 }
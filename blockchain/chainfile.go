@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Portable chain files: a header with the consensus engine of the chain,
+//then every block of the main chain from genesis, each prefixed with its
+//length as a uvarint. Files may be gzipped, ImportChain detects it.
+var chainFileMagic = []byte("blkchain")
+
+const (
+	chainFileVersion = 1
+	//largest block or header ImportChain reads
+	maxChainFileRecord = 32 << 20
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+//write the main chain to w, returning the number of blocks
+func (chain *Blockchain) ExportChain(w io.Writer, compress bool) (int, error) {
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	bw := bufio.NewWriter(w)
+
+	enc := encoder{}
+	enc.uvarint(chainFileVersion)
+	enc.bytes(encodeEngine(chain.Engine))
+	if _, err := bw.Write(chainFileMagic); err != nil {
+		return 0, err
+	}
+	if err := writeRecord(bw, enc.buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	hashes := chain.BlockHashes()
+	for _, hash := range hashes {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return 0, err
+		}
+		if err := writeRecord(bw, block.Serialize()); err != nil {
+			return 0, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return len(hashes), nil
+}
+
+func writeRecord(w io.Writer, record []byte) error {
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(record)))
+	if _, err := w.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(record)
+	return err
+}
+
+//next record, io.EOF at the end of the file
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxChainFileRecord {
+		return nil, fmt.Errorf("record of %d bytes is too large", length)
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return record, nil
+}
+
+//create a new chain from a file written by ExportChain, validating every
+//block as it is connected. On error the blocks imported so far are kept.
+//Returns the chain and the number of blocks imported.
+func ImportChain(r io.Reader) (*Blockchain, int, error) {
+	if DBexists() {
+		return nil, 0, errors.New("blockchain already exists")
+	}
+
+	br, engine, err := openChainFile(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	genesis, err := readBlock(br)
+	if err == io.EOF {
+		return nil, 0, errors.New("chain file has no blocks")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkGenesis(engine, genesis); err != nil {
+		return nil, 0, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return nil, 0, err
+	}
+	chain := &Blockchain{Database: db, Engine: engine}
+	if err := chain.storeGenesis(genesis); err != nil {
+		return chain, 0, err
+	}
+
+	count := 1
+	for {
+		block, err := readBlock(br)
+		if err == io.EOF {
+			return chain, count, nil
+		}
+		if err != nil {
+			return chain, count, err
+		}
+		if err := chain.ConnectBlock(block); err != nil {
+			return chain, count, err
+		}
+		count++
+	}
+}
+
+//read the header of a chain file, returning a reader positioned at the
+//first block and the consensus engine of the chain
+func openChainFile(r io.Reader) (*bufio.Reader, ConsensusEngine, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		br = bufio.NewReader(zr)
+	}
+
+	magic := make([]byte, len(chainFileMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, chainFileMagic) {
+		return nil, nil, errors.New("not a chain file")
+	}
+	header, err := readRecord(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading header: %v", err)
+	}
+	dec := newDecoder(header)
+	dec.version(chainFileVersion)
+	encodedEngine := dec.bytes()
+	if err := dec.finish(); err != nil {
+		return nil, nil, fmt.Errorf("reading header: %v", err)
+	}
+	engine, err := decodeEngine(encodedEngine)
+	return br, engine, err
+}
+
+func readBlock(r *bufio.Reader) (block *Block, err error) {
+	record, err := readRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	//Deserialize panics on malformed blocks
+	defer func() {
+		if recover() != nil {
+			block, err = nil, errors.New("malformed block in chain file")
+		}
+	}()
+	return Deserialize(record), nil
+}
+
+//the genesis block holds a single coinbase and a valid seal
+func checkGenesis(engine ConsensusEngine, genesis *Block) error {
+	if len(genesis.PrevHash) != 0 {
+		return errors.New("chain file doesn't start with a genesis block")
+	}
+	if genesis.MerkleRoot != nil {
+		return fmt.Errorf("genesis block: %v", errStoredMerkleRoot)
+	}
+	if len(genesis.Transactions) != 1 || !genesis.Transactions[0].IsCoinBase() {
+		return errors.New("genesis block must hold a single coinbase")
+	}
+	tx := genesis.Transactions[0]
+	if !bytes.Equal(tx.ID, genesis.txID(tx)) {
+		return fmt.Errorf("transaction %x: id doesn't match its contents", tx.ID)
+	}
+	if err := checkCoinbase(tx, 0); err != nil {
+		return fmt.Errorf("transaction %x: %v", tx.ID, err)
+	}
+	//the seal of a genesis block doesn't depend on earlier blocks
+	if err := engine.VerifySeal(&Blockchain{Engine: engine}, genesis); err != nil {
+		return fmt.Errorf("genesis block: %v", err)
+	}
+	return nil
+}
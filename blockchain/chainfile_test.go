@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/shraddha0602/blockchain-implementation/wallet"
+)
+
+//run the test in a fresh directory, the database lives under ./tmp
+func chdirTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addressOf(w *wallet.Wallet) string {
+	return string(w.Address())
+}
+
+//transaction from the first output of prev paying amount to to, with the
+//change going back to from
+func spendTx(t *testing.T, chain *Blockchain, from *wallet.Wallet, prev *Transaction, to string, amount int) *Transaction {
+	outs := []TxOutput{*NewTXOutput(amount, to)}
+	if change := prev.Outputs[0].Value - amount; change > 0 {
+		outs = append(outs, *NewTXOutput(change, addressOf(from)))
+	}
+	tx := Transaction{nil, []TxInput{{prev.ID, 0, nil, from.PublicKey}}, outs}
+	tx.ID = tx.Hash()
+	chain.SignTransaction(&tx, from.PrivateKey)
+	return &tx
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	chdirTemp(t)
+	alice, bob := wallet.MakeWallet(), wallet.MakeWallet()
+
+	chain := InitBlockchain(addressOf(alice), PoWEngine{})
+	genesis, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay := spendTx(t, chain, alice, genesis.Transactions[0], addressOf(bob), 10)
+	chain.AddBlock([]*Transaction{CoinbaseTx(addressOf(bob), ""), pay})
+	stats, err := (UTXOSet{chain}).Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		var file bytes.Buffer
+		exported, err := chain.ExportChain(&file, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exported != 2 {
+			t.Fatalf("exported %d blocks, want 2", exported)
+		}
+
+		chdirTemp(t)
+		imported, count, err := ImportChain(&file)
+		if err != nil {
+			t.Fatalf("compress %v: %v", compress, err)
+		}
+		if count != exported {
+			t.Errorf("compress %v: imported %d blocks, want %d", compress, count, exported)
+		}
+		if !bytes.Equal(imported.LastHash(), chain.LastHash()) {
+			t.Errorf("compress %v: imported tip %x, want %x", compress, imported.LastHash(), chain.LastHash())
+		}
+		importedStats, err := (UTXOSet{imported}).Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(importedStats.Hash(), stats.Hash()) || importedStats.Total != stats.Total {
+			t.Errorf("compress %v: imported UTXO set %x of %d, want %x of %d", compress,
+				importedStats.Hash(), importedStats.Total, stats.Hash(), stats.Total)
+		}
+		imported.Database.Close()
+	}
+	chain.Database.Close()
+}
+
+func TestCheckBlockRejects(t *testing.T) {
+	chdirTemp(t)
+	alice, mallory := wallet.MakeWallet(), wallet.MakeWallet()
+
+	chain := InitBlockchain(addressOf(alice), PoWEngine{})
+	defer chain.Database.Close()
+	genesis, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overpaid := CoinbaseTx(addressOf(mallory), "")
+	overpaid.Outputs[0].Value = subsidy + 1
+	overpaid.ID = overpaid.Hash()
+
+	negative := CoinbaseTx(addressOf(mallory), "")
+	negative.Outputs = append(negative.Outputs, *NewTXOutput(-1, addressOf(mallory)))
+	negative.ID = negative.Hash()
+
+	//locked to alice's hash followed by junk, sharing the prefix of her
+	//address index entries
+	colliding := CoinbaseTx(addressOf(mallory), "")
+	colliding.Outputs[0].PubKeyHash = append(wallet.PublicKeyHash(alice.PublicKey), 0xff)
+	colliding.ID = colliding.Hash()
+
+	oversized := CoinbaseTx(addressOf(mallory), "")
+	oversized.Outputs = append(oversized.Outputs, TxOutput{0, nil, make([]byte, MaxDataSize+1)})
+	oversized.ID = oversized.Hash()
+
+	//data outputs are kept out of the UTXO set, value sent to them is burnt
+	valuedData := CoinbaseTx(addressOf(mallory), "")
+	valuedData.Outputs = append(valuedData.Outputs, TxOutput{1, wallet.PublicKeyHash(mallory.PublicKey), []byte("data")})
+	valuedData.Outputs[0].Value--
+	valuedData.ID = valuedData.Hash()
+
+	//spends alice's coins with a valid signature of another key
+	stolen := spendTx(t, chain, mallory, genesis.Transactions[0], addressOf(mallory), subsidy)
+
+	tests := []struct {
+		name string
+		txs  []*Transaction
+	}{
+		{"coinbase pays more than the subsidy", []*Transaction{overpaid}},
+		{"coinbase with a negative output", []*Transaction{negative}},
+		{"output locked to a longer hash", []*Transaction{colliding}},
+		{"data output over the maximum size", []*Transaction{oversized}},
+		{"data output with a value and a public key hash", []*Transaction{valuedData}},
+		{"input signed by a key not owning the output", []*Transaction{CoinbaseTx(addressOf(mallory), ""), stolen}},
+	}
+	for _, test := range tests {
+		block, err := chain.sealBlock(test.txs, chain.LastHash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := chain.ConnectBlock(block); err == nil {
+			t.Errorf("%s: block was connected", test.name)
+		}
+	}
+}
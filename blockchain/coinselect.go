@@ -0,0 +1,230 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Coin selection picks which unspent outputs fund a new transaction.
+type CoinSelection string
+
+const (
+	//fewest inputs, biggest outputs first
+	SelectLargestFirst CoinSelection = "largest-first"
+	//consolidate dust, smallest outputs first
+	SelectSmallestFirst CoinSelection = "smallest-first"
+	//search for inputs adding up to exactly the amount so no change is
+	//needed, largest-first when there is no such set
+	SelectBranchAndBound CoinSelection = "branch-and-bound"
+	//random inputs, then more while the change gets closer to the amount
+	SelectRandomImprove CoinSelection = "random-improve"
+)
+
+//branch-and-bound gives up after this many steps
+const bnbMaxTries = 100000
+
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+//unspent output, Value is filled in once it is looked up
+type UTXO struct {
+	TxID  []byte
+	Index int
+	Value int
+}
+
+//which outputs a new transaction spends
+type CoinControl struct {
+	Strategy CoinSelection
+	//spend exactly these outputs, Strategy is ignored
+	Outpoints []UTXO
+}
+
+func (s CoinSelection) IsValid() bool {
+	switch s {
+	case SelectLargestFirst, SelectSmallestFirst, SelectBranchAndBound, SelectRandomImprove:
+		return true
+	}
+	return false
+}
+
+//parse txid:index
+func ParseOutpoint(s string) (UTXO, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return UTXO{}, fmt.Errorf("outpoint %q is not txid:index", s)
+	}
+	txID, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return UTXO{}, fmt.Errorf("outpoint %q has an invalid txid", s)
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil || index < 0 {
+		return UTXO{}, fmt.Errorf("outpoint %q has an invalid index", s)
+	}
+	return UTXO{TxID: txID, Index: index}, nil
+}
+
+func (u UTXO) String() string {
+	return fmt.Sprintf("%x:%d", u.TxID, u.Index)
+}
+
+//outputs of publicKeyHash paying for amount
+func (control CoinControl) selectCoins(set *UTXOSet, publicKeyHash []byte, amount int) ([]UTXO, error) {
+	if len(control.Outpoints) == 0 {
+		return SelectCoins(set.FindSpendableOutputs(publicKeyHash), amount, control.Strategy)
+	}
+
+	var selected []UTXO
+	seen := make(map[string]bool)
+	acc := 0
+	for _, outpoint := range control.Outpoints {
+		if seen[outpoint.String()] {
+			return nil, fmt.Errorf("outpoint %s is listed twice", outpoint)
+		}
+		seen[outpoint.String()] = true
+
+		out, ok := set.FindOutput(outpoint.TxID, outpoint.Index)
+		if !ok {
+			return nil, fmt.Errorf("outpoint %s is not an unspent output", outpoint)
+		}
+		if !out.IsLockedWithKey(publicKeyHash) {
+			return nil, fmt.Errorf("outpoint %s doesn't belong to the sender", outpoint)
+		}
+		outpoint.Value = out.Value
+		selected = append(selected, outpoint)
+		acc += out.Value
+	}
+	if acc < amount {
+		return nil, fmt.Errorf("%w: outpoints hold %d, need %d", ErrInsufficientFunds, acc, amount)
+	}
+	return selected, nil
+}
+
+//choose outputs of utxos worth at least amount
+func SelectCoins(utxos []UTXO, amount int, strategy CoinSelection) ([]UTXO, error) {
+	total := 0
+	for _, utxo := range utxos {
+		total += utxo.Value
+	}
+	if total < amount {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, total, amount)
+	}
+
+	switch strategy {
+	case SelectLargestFirst, "":
+		return accumulate(sortedUTXOs(utxos, true), amount), nil
+	case SelectSmallestFirst:
+		return accumulate(sortedUTXOs(utxos, false), amount), nil
+	case SelectBranchAndBound:
+		if selected := branchAndBound(utxos, amount); selected != nil {
+			return selected, nil
+		}
+		return accumulate(sortedUTXOs(utxos, true), amount), nil
+	case SelectRandomImprove:
+		return randomImprove(utxos, amount), nil
+	}
+	return nil, fmt.Errorf("unknown coin selection %q", strategy)
+}
+
+func sortedUTXOs(utxos []UTXO, descending bool) []UTXO {
+	sorted := append([]UTXO(nil), utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if descending {
+			return sorted[i].Value > sorted[j].Value
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
+
+//take utxos in order until amount is reached
+func accumulate(utxos []UTXO, amount int) []UTXO {
+	var selected []UTXO
+	acc := 0
+	for _, utxo := range utxos {
+		if acc >= amount && len(selected) > 0 {
+			break
+		}
+		selected = append(selected, utxo)
+		acc += utxo.Value
+	}
+	return selected
+}
+
+//depth first search for a subset worth exactly amount, nil when none is found
+func branchAndBound(utxos []UTXO, amount int) []UTXO {
+	sorted := sortedUTXOs(utxos, true)
+	//remaining[i] is the value of sorted[i:]
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Value
+	}
+
+	tries := 0
+	var chosen []int
+	var search func(i, acc int) bool
+	search = func(i, acc int) bool {
+		tries++
+		switch {
+		case acc == amount && len(chosen) > 0:
+			return true
+		case acc > amount, i == len(sorted), acc+remaining[i] < amount, tries > bnbMaxTries:
+			return false
+		}
+		chosen = append(chosen, i)
+		if search(i+1, acc+sorted[i].Value) {
+			return true
+		}
+		chosen = chosen[:len(chosen)-1]
+		return search(i+1, acc)
+	}
+	if !search(0, 0) {
+		return nil
+	}
+
+	selected := make([]UTXO, len(chosen))
+	for n, i := range chosen {
+		selected[n] = sorted[i]
+	}
+	return selected
+}
+
+//Random-improve: random utxos until amount is covered, then keep adding
+//random ones while they bring the change closer to amount (an output
+//worth twice the payment) without going over three times amount.
+func randomImprove(utxos []UTXO, amount int) []UTXO {
+	shuffled := append([]UTXO(nil), utxos...)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	selected := accumulate(shuffled, amount)
+	acc := 0
+	for _, utxo := range selected {
+		acc += utxo.Value
+	}
+
+	ideal, limit := 2*amount, 3*amount
+	for _, utxo := range shuffled[len(selected):] {
+		next := acc + utxo.Value
+		if next <= limit && distance(next, ideal) < distance(acc, ideal) {
+			selected = append(selected, utxo)
+			acc = next
+		}
+	}
+	return selected
+}
+
+func distance(a, b int) int {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+//stores which engine the chain was created with, and its parameters
+var consensusKey = []byte("consensus")
+
+//Rules deciding who may add a block and how it is proven
+type ConsensusEngine interface {
+	//name stored with the chain, e.g. "pow"
+	Name() string
+	//fill in consensus fields of a new block before it is sealed
+	Prepare(chain *Blockchain, block *Block) error
+	//produce the proof of the block and its hash, stopping when ctx is done
+	Seal(ctx context.Context, chain *Blockchain, block *Block) error
+	//check the proof of a block built on top of the chain
+	VerifySeal(chain *Blockchain, block *Block) error
+	//difficulty a block on top of parent (nil for genesis) must meet
+	Difficulty(chain *Blockchain, parent *Block) int
+}
+
+//Proof of work, every block needs a hash below the target
+type PoWEngine struct{}
+
+func (PoWEngine) Name() string {
+	return "pow"
+}
+
+func (PoWEngine) Prepare(chain *Blockchain, block *Block) error {
+	return nil
+}
+
+func (e PoWEngine) Seal(ctx context.Context, chain *Blockchain, block *Block) error {
+	difficulty, err := e.blockDifficulty(chain, block)
+	if err != nil {
+		return err
+	}
+	pow := NewProof(block, difficulty)
+	nonce, hash, err := pow.RunContext(ctx)
+	if err != nil {
+		return err
+	}
+	if chain != nil {
+		chain.setHashRate(pow.HashRate())
+	}
+
+	block.Hash = hash[:]
+	block.Nonce = nonce
+	return nil
+}
+
+func (e PoWEngine) VerifySeal(chain *Blockchain, block *Block) error {
+	difficulty, err := e.blockDifficulty(chain, block)
+	if err != nil {
+		return err
+	}
+	if !NewProof(block, difficulty).Validate() {
+		return errors.New("block hash doesn't match its contents or the proof of work target")
+	}
+	return nil
+}
+
+func (PoWEngine) Difficulty(chain *Blockchain, parent *Block) int {
+	return Difficulty
+}
+
+//difficulty block must meet, its parent is looked up on chain when there
+//is one to read
+func (e PoWEngine) blockDifficulty(chain *Blockchain, block *Block) (int, error) {
+	var parent *Block
+	if chain != nil && chain.Database != nil && len(block.PrevHash) > 0 {
+		var err error
+		if parent, err = chain.getBlock(block.PrevHash); err != nil {
+			return 0, fmt.Errorf("parent %x: %v", block.PrevHash, err)
+		}
+	}
+	return e.Difficulty(chain, parent), nil
+}
+
+//write the engine of a new chain
+func saveEngine(txn *badger.Txn, engine ConsensusEngine) error {
+	return txn.Set(consensusKey, encodeEngine(engine))
+}
+
+func encodeEngine(engine ConsensusEngine) []byte {
+	enc := encoder{}
+	enc.uvarint(serializationVersion)
+	enc.bytes([]byte(engine.Name()))
+	if poa, ok := engine.(*PoAEngine); ok {
+		enc.uvarint(uint64(len(poa.InitialSigners)))
+		for _, signer := range poa.InitialSigners {
+			enc.bytes(signer)
+		}
+	}
+	return enc.buf.Bytes()
+}
+
+//read the engine of an existing chain, chains without one use proof of work
+func loadEngine(txn *badger.Txn) (ConsensusEngine, error) {
+	item, err := txn.Get(consensusKey)
+	if err == badger.ErrKeyNotFound {
+		return PoWEngine{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+	return decodeEngine(value)
+}
+
+func decodeEngine(value []byte) (ConsensusEngine, error) {
+	dec := newDecoder(value)
+	dec.version(serializationVersion)
+	name := string(dec.bytes())
+
+	var engine ConsensusEngine
+	switch name {
+	case "pow":
+		engine = PoWEngine{}
+	case "poa":
+		var signers [][]byte
+		for n := dec.length(); n > 0 && dec.err == nil; n-- {
+			signers = append(signers, dec.bytes())
+		}
+		engine = NewPoAEngine(signers)
+	default:
+		return nil, fmt.Errorf("unknown consensus engine %q", name)
+	}
+	return engine, dec.finish()
+}
@@ -0,0 +1,162 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//Canonical binary encoding used for hashing, storage and networking.
+//Every serialized object starts with the format version, followed by its
+//fields in declaration order. Integers are varints (signed ones zig-zag
+//encoded) and byte strings and lists are prefixed with their length.
+//Transactions are hashed in this encoding, so their version only changes
+//with a new block version.
+const serializationVersion = 1
+
+//Blocks are versioned on their own, version 2 added the seal and version 3
+//the Merkle root kept by pruned blocks
+const blockSerializationVersion = 3
+
+//upper bound on any length prefix, protects against corrupt input
+const maxEncodedLength = 32 << 20
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (enc *encoder) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	enc.buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func (enc *encoder) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	enc.buf.Write(tmp[:binary.PutVarint(tmp[:], v)])
+}
+
+func (enc *encoder) bytes(data []byte) {
+	enc.uvarint(uint64(len(data)))
+	enc.buf.Write(data)
+}
+
+func (enc *encoder) input(in TxInput) {
+	enc.bytes(in.ID)
+	enc.varint(int64(in.Out))
+	enc.bytes(in.Signature)
+	enc.bytes(in.PubKey)
+}
+
+func (enc *encoder) output(out TxOutput) {
+	enc.varint(int64(out.Value))
+	enc.bytes(out.PubKeyHash)
+	enc.bytes(out.Data)
+}
+
+func (enc *encoder) transaction(tx *Transaction) {
+	enc.bytes(tx.ID)
+	enc.uvarint(uint64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		enc.input(in)
+	}
+	enc.uvarint(uint64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		enc.output(out)
+	}
+}
+
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newDecoder(data []byte) *decoder {
+	return &decoder{r: bytes.NewReader(data)}
+}
+
+//read the format version, versions above latest are rejected
+func (dec *decoder) version(latest uint64) uint64 {
+	v := dec.uvarint()
+	if dec.err == nil && (v == 0 || v > latest) {
+		dec.err = fmt.Errorf("unsupported serialization version %d", v)
+	}
+	return v
+}
+
+func (dec *decoder) uvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(dec.r)
+	dec.err = err
+	return v
+}
+
+func (dec *decoder) varint() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(dec.r)
+	dec.err = err
+	return v
+}
+
+func (dec *decoder) length() int {
+	n := dec.uvarint()
+	if dec.err == nil && (n > maxEncodedLength || n > uint64(dec.r.Len())) {
+		dec.err = errors.New("encoded length exceeds available data")
+		return 0
+	}
+	return int(n)
+}
+
+func (dec *decoder) bytes() []byte {
+	n := dec.length()
+	if dec.err != nil || n == 0 {
+		return nil
+	}
+	data := make([]byte, n)
+	_, dec.err = dec.r.Read(data)
+	return data
+}
+
+func (dec *decoder) input() TxInput {
+	var in TxInput
+	in.ID = dec.bytes()
+	in.Out = int(dec.varint())
+	in.Signature = dec.bytes()
+	in.PubKey = dec.bytes()
+	return in
+}
+
+func (dec *decoder) output() TxOutput {
+	var out TxOutput
+	out.Value = int(dec.varint())
+	out.PubKeyHash = dec.bytes()
+	out.Data = dec.bytes()
+	return out
+}
+
+func (dec *decoder) transaction() *Transaction {
+	tx := &Transaction{}
+	tx.ID = dec.bytes()
+	for n := dec.length(); n > 0 && dec.err == nil; n-- {
+		tx.Inputs = append(tx.Inputs, dec.input())
+	}
+	for n := dec.length(); n > 0 && dec.err == nil; n-- {
+		tx.Outputs = append(tx.Outputs, dec.output())
+	}
+	return tx
+}
+
+//error if decoding failed or left bytes behind
+func (dec *decoder) finish() error {
+	if dec.err != nil {
+		return dec.err
+	}
+	if dec.r.Len() != 0 {
+		return errors.New("trailing data after encoded object")
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+//Optional indexes kept in step with the main chain. An index is enabled
+//while its marker key exists, the marker holds the hash of the last block
+//it indexed. Blocks are connected and disconnected in the same transaction
+//that moves the tip so an index never disagrees with the chain, one whose
+//marker isn't the tip is left disabled until it is rebuilt.
+type chainIndex interface {
+	//name used on the command line
+	Name() string
+	//marker key
+	key() []byte
+	//prefix of the entries, cleared when the index is rebuilt
+	prefix() []byte
+	//spent holds the outputs spent by block keyed by outpointKey
+	connect(txn *badger.Txn, block *Block, spent map[string]TxOutput) error
+	disconnect(txn *badger.Txn, block *Block, spent map[string]TxOutput) error
+}
+
+var chainIndexes = []chainIndex{txIndex{}, addrIndex{}}
+
+var ErrIndexDisabled = errors.New("index is not enabled, build it first")
+
+func indexByName(name string) (chainIndex, error) {
+	for _, index := range chainIndexes {
+		if index.Name() == name {
+			return index, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown index %q", name)
+}
+
+//indexes enabled in the database that are at the tip lastHash
+func loadIndexes(txn *badger.Txn, lastHash []byte) ([]chainIndex, error) {
+	var enabled []chainIndex
+	for _, index := range chainIndexes {
+		item, err := txn.Get(index.key())
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		marker, err := item.Value()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(marker, lastHash) {
+			fmt.Printf("%s stopped at block %x, rebuild it with buildindex\n", index.Name(), marker)
+			continue
+		}
+		enabled = append(enabled, index)
+	}
+	return enabled, nil
+}
+
+func (chain *Blockchain) HasIndex(name string) bool {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+	for _, index := range chain.indexes {
+		if index.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+//add block to the enabled indexes after its outputs were applied to the
+//UTXO set in txn, the caller holds the writer lock
+func (chain *Blockchain) connectIndexes(txn *badger.Txn, block *Block) error {
+	if len(chain.indexes) == 0 {
+		return nil
+	}
+	spent := make(map[string]TxOutput)
+	if err := readUndo(txn, block, spent); err != nil {
+		return err
+	}
+	for _, index := range chain.indexes {
+		if err := index.connect(txn, block, spent); err != nil {
+			return err
+		}
+		if err := txn.Set(index.key(), block.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//remove the tip block from the enabled indexes, spent holds the outputs
+//it spent. The caller holds the writer lock
+func (chain *Blockchain) disconnectIndexes(txn *badger.Txn, block *Block, spent map[string]TxOutput) error {
+	for _, index := range chain.indexes {
+		if err := index.disconnect(txn, block, spent); err != nil {
+			return err
+		}
+		if err := txn.Set(index.key(), block.PrevHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//(re)build index name from the genesis block and keep it enabled
+func (chain *Blockchain) BuildIndex(name string) error {
+	index, err := indexByName(name)
+	if err != nil {
+		return err
+	}
+	chain.writer.Lock()
+	defer chain.writer.Unlock()
+	if chain.HasPrunedBlocks() {
+		return fmt.Errorf("building %s needs every block: %w", name, ErrBlockPruned)
+	}
+
+	if err := chain.dropIndex(index); err != nil {
+		return err
+	}
+
+	//the marker is only set once every block is indexed, an interrupted
+	//build leaves the index disabled
+	hashes := chain.BlockHashes()
+	for _, hash := range hashes {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		spent, err := (&UTXOSet{chain}).spentOutputs(block)
+		if err != nil {
+			return err
+		}
+		err = chain.Database.Update(func(txn *badger.Txn) error {
+			return index.connect(txn, block, spent)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(index.key(), hashes[len(hashes)-1])
+	})
+	if err != nil {
+		return err
+	}
+	chain.mu.Lock()
+	chain.indexes = append(chain.indexes, index)
+	chain.mu.Unlock()
+	return nil
+}
+
+//disable index name and delete its entries
+func (chain *Blockchain) DropIndex(name string) error {
+	index, err := indexByName(name)
+	if err != nil {
+		return err
+	}
+	chain.writer.Lock()
+	defer chain.writer.Unlock()
+	return chain.dropIndex(index)
+}
+
+func (chain *Blockchain) dropIndex(index chainIndex) error {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(index.key())
+	})
+	if err != nil {
+		return err
+	}
+	(&UTXOSet{Blockchain: chain}).DeleteByPrefix(index.prefix())
+
+	var enabled []chainIndex
+	for _, other := range chain.indexes {
+		if other.Name() != index.Name() {
+			enabled = append(enabled, other)
+		}
+	}
+	chain.mu.Lock()
+	chain.indexes = enabled
+	chain.mu.Unlock()
+	return nil
+}
+
+//Transaction index, txid -> hash of the block holding it and the position
+//of the transaction in the block.
+var (
+	txIndexKey    = []byte("txindex")
+	txIndexPrefix = []byte("tx-")
+)
+
+type txIndex struct{}
+
+func (txIndex) Name() string   { return "txindex" }
+func (txIndex) key() []byte    { return txIndexKey }
+func (txIndex) prefix() []byte { return txIndexPrefix }
+
+func (txIndex) connect(txn *badger.Txn, block *Block, spent map[string]TxOutput) error {
+	for pos, tx := range block.Transactions {
+		enc := encoder{}
+		enc.bytes(block.Hash)
+		enc.uvarint(uint64(pos))
+		if err := txn.Set(txIndexEntry(tx.ID), enc.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (txIndex) disconnect(txn *badger.Txn, block *Block, spent map[string]TxOutput) error {
+	for _, tx := range block.Transactions {
+		key := txIndexEntry(tx.ID)
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		//an identical transaction in an older block keeps its entry
+		if hash, _, err := decodeTxLocation(value); err == nil && !bytes.Equal(hash, block.Hash) {
+			continue
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func txIndexEntry(txID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txID...)
+}
+
+func decodeTxLocation(value []byte) ([]byte, int, error) {
+	dec := newDecoder(value)
+	hash := dec.bytes()
+	pos := int(dec.uvarint())
+	return hash, pos, dec.finish()
+}
+
+//block hash and position of transaction ID, found is false when it isn't indexed
+func (chain *Blockchain) LocateTransaction(ID []byte) (blockHash []byte, pos int, found bool, err error) {
+	if !chain.HasIndex(txIndex{}.Name()) {
+		return nil, 0, false, ErrIndexDisabled
+	}
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(txIndexEntry(ID))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		blockHash, pos, err = decodeTxLocation(value)
+		found = err == nil
+		return err
+	})
+	return blockHash, pos, found, err
+}
@@ -1,7 +1,9 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 )
 
 type MerkleTree struct {
@@ -14,6 +16,12 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+//sibling hashes needed to recompute the root from a single leaf
+type MerkleProof struct {
+	Index  int //position of the leaf
+	Hashes [][]byte
+}
+
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
 
@@ -21,9 +29,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 		hash := sha256.Sum256(data)
 		node.Data = hash[:]
 	} else {
-		temp := append(left.Data, right.Data...)
-		hash := sha256.Sum256(temp)
-		node.Data = hash[:]
+		node.Data = hashPair(left.Data, right.Data)
 	}
 	node.Left = left
 	node.Right = right
@@ -33,16 +39,16 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
 
-	if len(nodes)%2 != 0 {
-		data = append(data, data[len(data)-1])
-	}
-
 	for _, temp := range data {
 		node := NewMerkleNode(nil, nil, temp)
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	//odd levels duplicate their last node
+	for len(nodes) > 1 {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
 		var lvl []MerkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
@@ -54,3 +60,53 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 	tree := MerkleTree{&nodes[0]}
 	return &tree
 }
+
+//build the proof that data[index] is part of the tree
+func NewMerkleProof(data [][]byte, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(data) {
+		return nil, errors.New("Merkle proof index out of range")
+	}
+	var lvl [][]byte
+	for _, temp := range data {
+		hash := sha256.Sum256(temp)
+		lvl = append(lvl, hash[:])
+	}
+
+	proof := MerkleProof{Index: index}
+	for pos := index; len(lvl) > 1; pos /= 2 {
+		if len(lvl)%2 != 0 {
+			lvl = append(lvl, lvl[len(lvl)-1])
+		}
+		proof.Hashes = append(proof.Hashes, lvl[pos^1])
+
+		var next [][]byte
+		for j := 0; j < len(lvl); j += 2 {
+			next = append(next, hashPair(lvl[j], lvl[j+1]))
+		}
+		lvl = next
+	}
+	return &proof, nil
+}
+
+//recompute the root from leaf and compare it with root
+func (proof *MerkleProof) Verify(leaf, root []byte) bool {
+	hash := sha256.Sum256(leaf)
+	current := hash[:]
+
+	pos := proof.Index
+	for _, sibling := range proof.Hashes {
+		if pos%2 == 0 {
+			current = hashPair(current, sibling)
+		} else {
+			current = hashPair(sibling, current)
+		}
+		pos /= 2
+	}
+	return bytes.Equal(current, root)
+}
+
+func hashPair(left, right []byte) []byte {
+	temp := append(append([]byte{}, left...), right...)
+	hash := sha256.Sum256(temp)
+	return hash[:]
+}
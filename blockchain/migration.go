@@ -0,0 +1,284 @@
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+//Schema version of the database, stored under schemaKey and raised by the
+//migration steps below as ContinueBlockchain runs them in order. A new
+//step goes at the end of migrations with the next version, new databases
+//start at the latest one.
+var schemaKey = []byte("schema")
+
+//set by the encoding migration before schema versions were stored
+var encodingKey = []byte("encoding")
+
+//a step raising the schema to Version
+type Migration struct {
+	Version     int
+	Description string
+	migrate     func(db *badger.DB, dryRun bool) error
+}
+
+var migrations = []Migration{
+	{1, "store blocks and UTXO entries in the canonical encoding", migrateEncoding},
+	{2, "keep the count, total and hash of the UTXO set", migrateUTXOStats},
+	{3, "record the block the UTXO set is at", migrateUTXOTip},
+}
+
+//schema version written by this build
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+type dbEntry struct {
+	key, value []byte
+}
+
+//databases from before schema versions were stored are version 1 once
+//their encoding was migrated, 0 otherwise
+func loadSchemaVersion(txn *badger.Txn) (int, error) {
+	version, err := getInt(txn, schemaKey)
+	if err != badger.ErrKeyNotFound {
+		return version, err
+	}
+	_, err = txn.Get(encodingKey)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	return 1, err
+}
+
+//run the migrations the database is missing, returning them. With dryRun
+//the steps only check they can run and the database is left as it is.
+//Databases written by a newer version are refused.
+func migrateDatabase(db *badger.DB, dryRun bool) ([]Migration, error) {
+	var version int
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		version, err = loadSchemaVersion(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("database schema version %d is newer than version %d of this build", version, SchemaVersion)
+	}
+
+	var pending []Migration
+	for _, step := range migrations {
+		if step.Version <= version {
+			continue
+		}
+		if err := step.migrate(db, dryRun); err != nil {
+			return pending, fmt.Errorf("migrating to schema version %d: %v", step.Version, err)
+		}
+		pending = append(pending, step)
+		if dryRun {
+			continue
+		}
+		err := db.Update(func(txn *badger.Txn) error {
+			return setInt(txn, schemaKey, step.Version)
+		})
+		if err != nil {
+			return pending, err
+		}
+	}
+	return pending, nil
+}
+
+//open the database and run its pending migrations, or with dryRun only
+//list them after checking they can run
+func MigrateDatabase(dryRun bool) ([]Migration, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrateDatabase(db, dryRun)
+}
+
+//rewrite of gob encoded blocks and UTXO entries
+//migrated blocks keep their hash and LegacyBlockVersion so they still validate.
+//Entries already in the canonical encoding are left alone, so a migration
+//stopped half way through picks up where it was
+func migrateEncoding(db *badger.DB, dryRun bool) error {
+	var entries []dbEntry
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		hash, err := item.Value()
+		if err != nil {
+			return err
+		}
+
+		for len(hash) > 0 {
+			item, err := txn.Get(hash)
+			if err != nil {
+				return err
+			}
+			value, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if block, err := decodeBlock(value); err == nil {
+				hash = block.PrevHash
+				continue
+			}
+			block, err := legacyDeserialize(value)
+			if err != nil {
+				return fmt.Errorf("decoding block %x: %v", hash, err)
+			}
+			entries = append(entries, dbEntry{item.KeyCopy(nil), block.Serialize()})
+			hash = block.PrevHash
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			value, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			if _, err := decodeOutputs(value); err == nil {
+				continue
+			}
+			outs, err := legacyDeserializeOutputs(value)
+			if err != nil {
+				return fmt.Errorf("decoding UTXO entry %x: %v", it.Item().Key(), err)
+			}
+			entries = append(entries, dbEntry{it.Item().KeyCopy(nil), outs.SerializeOutputs()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Printf("%d entries would be migrated to the canonical encoding\n", len(entries))
+		return nil
+	}
+	fmt.Printf("Migrated %d entries to the canonical encoding\n", len(entries))
+	return writeEntries(db, entries)
+}
+
+//store the stats of a UTXO set kept before they were tracked
+func migrateUTXOStats(db *badger.DB, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		stats, err := scanUTXOStats(txn)
+		if err != nil {
+			return err
+		}
+		return txn.Set(utxoStatsKey, stats.encode())
+	})
+}
+
+//write entries, splitting them over as many transactions as needed
+func writeEntries(db *badger.DB, entries []dbEntry) error {
+	w := newEntryWriter(db)
+	defer w.discard()
+
+	for _, entry := range entries {
+		if err := w.set(entry.key, entry.value); err != nil {
+			return err
+		}
+	}
+	return w.commit()
+}
+
+//writes entries as they are produced, committing a transaction each time
+//it fills up so they don't all have to be held in memory
+type entryWriter struct {
+	db  *badger.DB
+	txn *badger.Txn
+}
+
+func newEntryWriter(db *badger.DB) *entryWriter {
+	return &entryWriter{db, db.NewTransaction(true)}
+}
+
+func (w *entryWriter) set(key, value []byte) error {
+	err := w.txn.Set(key, value)
+	if err == badger.ErrTxnTooBig {
+		if err := w.txn.Commit(nil); err != nil {
+			return err
+		}
+		w.txn = w.db.NewTransaction(true)
+		err = w.txn.Set(key, value)
+	}
+	return err
+}
+
+func (w *entryWriter) commit() error {
+	return w.txn.Commit(nil)
+}
+
+func (w *entryWriter) discard() {
+	w.txn.Discard()
+}
+
+//record the block the UTXO set is at. Older versions updated it right
+//after storing a block, so it is at the tip unless they stopped in between,
+//which leaves it one block behind. ContinueBlockchain catches it up.
+func migrateUTXOTip(db *badger.DB, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		lastHash, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		item, err = txn.Get(lastHash)
+		if err != nil {
+			return err
+		}
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		tip := Deserialize(value)
+
+		utxoTip := lastHash
+		if !tip.Pruned() {
+			applied, err := hasOutputsOf(txn, tip)
+			if err != nil {
+				return err
+			}
+			if !applied {
+				utxoTip = tip.PrevHash
+			}
+		}
+		return txn.Set(utxoTipKey, utxoTip)
+	})
+}
+
+//true when the UTXO set has outputs of block or the block creates none,
+//nothing after the tip can have spent them all
+func hasOutputsOf(txn *badger.Txn, block *Block) (bool, error) {
+	creates := false
+	for _, tx := range block.Transactions {
+		_, err := txn.Get(append(append([]byte{}, utxoPrefix...), tx.ID...))
+		if err == nil {
+			return true, nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return false, err
+		}
+		for _, out := range tx.Outputs {
+			creates = creates || !out.IsData()
+		}
+	}
+	return !creates, nil
+}
@@ -0,0 +1,338 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/shraddha0602/blockchain-implementation/wallet"
+)
+
+//prefix of the data output payload of a signer vote
+var voteMagic = []byte("poa-vote")
+
+//signer snapshots kept in memory, evicted ones are replayed from the chain
+const maxSnapshots = 1024
+
+//Proof of authority, a set of signers take turns sealing blocks.
+//The signer after the parent's sealer (in public key hash order) seals the
+//next block by signing its hash; the seal holds its public key and signature.
+//Signers vote to add or remove signers by including vote transactions in the
+//blocks they seal, a change applies once more than half of the signers agree.
+type PoAEngine struct {
+	InitialSigners [][]byte //public key hashes of the genesis signers
+
+	mu        sync.Mutex
+	keys      map[string]ecdsa.PrivateKey //keys this node can seal with
+	snapshots map[string]*signerSnapshot  //signers after recent blocks
+	added     []string                    //keys of snapshots, oldest first
+}
+
+//signer set and pending votes after a block
+type signerSnapshot struct {
+	signers [][]byte
+	votes   map[string]map[string]bool //proposal -> voters
+}
+
+func NewPoAEngine(signers [][]byte) *PoAEngine {
+	return &PoAEngine{
+		InitialSigners: sortSigners(signers),
+		keys:           make(map[string]ecdsa.PrivateKey),
+		snapshots:      make(map[string]*signerSnapshot),
+	}
+}
+
+//let this node seal blocks with key when it is the key's turn
+func (poa *PoAEngine) Authorize(key ecdsa.PrivateKey) {
+	pubKeyHash := wallet.PublicKeyHash(wallet.PublicKeyBytes(&key.PublicKey))
+
+	poa.mu.Lock()
+	defer poa.mu.Unlock()
+	poa.keys[hex.EncodeToString(pubKeyHash)] = key
+}
+
+func (poa *PoAEngine) Name() string {
+	return "poa"
+}
+
+func (poa *PoAEngine) Prepare(chain *Blockchain, block *Block) error {
+	signer, err := poa.inTurnSigner(chain, block)
+	if err != nil {
+		return err
+	}
+
+	poa.mu.Lock()
+	defer poa.mu.Unlock()
+	if _, ok := poa.keys[hex.EncodeToString(signer)]; !ok {
+		return fmt.Errorf("not authorized to seal, signer in turn is %x", signer)
+	}
+	return nil
+}
+
+func (poa *PoAEngine) Seal(ctx context.Context, chain *Blockchain, block *Block) error {
+	signer, err := poa.inTurnSigner(chain, block)
+	if err != nil {
+		return err
+	}
+	poa.mu.Lock()
+	key, ok := poa.keys[hex.EncodeToString(signer)]
+	poa.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not authorized to seal, signer in turn is %x", signer)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	hash := sealHash(block)
+	sign, err := wallet.Sign(&key, hash)
+	if err != nil {
+		return err
+	}
+
+	block.Hash = hash
+	block.Nonce = 0
+	block.Seal = append(wallet.PublicKeyBytes(&key.PublicKey), sign...)
+	return nil
+}
+
+func (poa *PoAEngine) VerifySeal(chain *Blockchain, block *Block) error {
+	signer, err := poa.inTurnSigner(chain, block)
+	if err != nil {
+		return err
+	}
+	pubKey, sign, err := splitSeal(block.Seal)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(pubKey), signer) {
+		return fmt.Errorf("block sealed out of turn, expected signer %x", signer)
+	}
+	hash := sealHash(block)
+	if !bytes.Equal(hash, block.Hash) {
+		return errors.New("block hash doesn't match its contents")
+	}
+	if !wallet.VerifySignature(pubKey, hash, sign) {
+		return errors.New("invalid signer signature")
+	}
+	return nil
+}
+
+//signers take turns, there is no difficulty to adjust
+func (poa *PoAEngine) Difficulty(chain *Blockchain, parent *Block) int {
+	return 1
+}
+
+//signers allowed to seal the child of the block with hash, nil for genesis
+func (poa *PoAEngine) Signers(chain *Blockchain, hash []byte) ([][]byte, error) {
+	snap, err := poa.snapshot(chain, hash)
+	if err != nil {
+		return nil, err
+	}
+	return snap.signers, nil
+}
+
+//signer expected to seal block
+func (poa *PoAEngine) inTurnSigner(chain *Blockchain, block *Block) ([]byte, error) {
+	signers, err := poa.Signers(chain, block.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no authorized signers left")
+	}
+
+	var prevSealer []byte
+	if len(block.PrevHash) > 0 {
+		parent, err := chain.GetBlock(block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		prevSealer, err = sealer(parent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, signer := range signers {
+		if bytes.Compare(signer, prevSealer) > 0 {
+			return signer, nil
+		}
+	}
+	return signers[0], nil
+}
+
+//replay votes from genesis, or the nearest known snapshot, up to hash
+func (poa *PoAEngine) snapshot(chain *Blockchain, hash []byte) (*signerSnapshot, error) {
+	poa.mu.Lock()
+	defer poa.mu.Unlock()
+
+	var blocks []*Block
+	snap := &signerSnapshot{poa.InitialSigners, map[string]map[string]bool{}}
+	for len(hash) > 0 {
+		if known, ok := poa.snapshots[string(hash)]; ok {
+			snap = known
+			break
+		}
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+		hash = block.PrevHash
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		next, err := snap.apply(blocks[i])
+		if err != nil {
+			return nil, err
+		}
+		snap = next
+		poa.remember(blocks[i].Hash, snap)
+	}
+	return snap, nil
+}
+
+//cache snap as the snapshot after block hash, dropping the oldest one
+//beyond maxSnapshots
+func (poa *PoAEngine) remember(hash []byte, snap *signerSnapshot) {
+	if _, ok := poa.snapshots[string(hash)]; !ok {
+		poa.added = append(poa.added, string(hash))
+	}
+	poa.snapshots[string(hash)] = snap
+	if len(poa.added) > maxSnapshots {
+		delete(poa.snapshots, poa.added[0])
+		poa.added = poa.added[1:]
+	}
+}
+
+//snapshot after counting the votes cast in block
+func (snap *signerSnapshot) apply(block *Block) (*signerSnapshot, error) {
+	voter, err := sealer(block)
+	if err != nil {
+		return nil, err
+	}
+	next := snap.copy()
+	if !next.isSigner(voter) {
+		return next, nil
+	}
+
+	for _, tx := range block.Transactions {
+		for _, out := range tx.Outputs {
+			signer, authorize, ok := parseVote(out)
+			if !ok {
+				continue
+			}
+			proposal := fmt.Sprintf("%t:%x", authorize, signer)
+			if next.votes[proposal] == nil {
+				next.votes[proposal] = map[string]bool{}
+			}
+			next.votes[proposal][string(voter)] = true
+
+			if 2*len(next.votes[proposal]) > len(next.signers) {
+				next.enact(signer, authorize)
+			}
+		}
+	}
+	return next, nil
+}
+
+//add or remove signer and drop votes that no longer apply
+func (snap *signerSnapshot) enact(signer []byte, authorize bool) {
+	delete(snap.votes, fmt.Sprintf("true:%x", signer))
+	delete(snap.votes, fmt.Sprintf("false:%x", signer))
+
+	if authorize {
+		if !snap.isSigner(signer) {
+			snap.signers = sortSigners(append(snap.signers, signer))
+		}
+		return
+	}
+
+	var signers [][]byte
+	for _, s := range snap.signers {
+		if !bytes.Equal(s, signer) {
+			signers = append(signers, s)
+		}
+	}
+	snap.signers = signers
+	for _, voters := range snap.votes {
+		delete(voters, string(signer))
+	}
+}
+
+func (snap *signerSnapshot) isSigner(pubKeyHash []byte) bool {
+	for _, signer := range snap.signers {
+		if bytes.Equal(signer, pubKeyHash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (snap *signerSnapshot) copy() *signerSnapshot {
+	votes := make(map[string]map[string]bool, len(snap.votes))
+	for proposal, voters := range snap.votes {
+		votes[proposal] = make(map[string]bool, len(voters))
+		for voter := range voters {
+			votes[proposal][voter] = true
+		}
+	}
+	return &signerSnapshot{append([][]byte{}, snap.signers...), votes}
+}
+
+//coinbase transaction carrying a vote to add or remove signer
+func VoteTx(to string, signer []byte, authorize bool) (*Transaction, error) {
+	op := byte(0)
+	if authorize {
+		op = 1
+	}
+	payload := append(append(append([]byte{}, voteMagic...), op), signer...)
+	return coinbaseDataTx(to, payload)
+}
+
+func parseVote(out TxOutput) ([]byte, bool, bool) {
+	if !out.IsData() || !bytes.HasPrefix(out.Data, voteMagic) || len(out.Data) <= len(voteMagic)+1 {
+		return nil, false, false
+	}
+	op := out.Data[len(voteMagic)]
+	if op > 1 {
+		return nil, false, false
+	}
+	return out.Data[len(voteMagic)+1:], op == 1, true
+}
+
+//hash a signer signs, it covers the header fields other than the seal
+func sealHash(block *Block) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{ToHex(int64(block.Version)), block.PrevHash, block.HashTransactions()}, []byte{}))
+	return hash[:]
+}
+
+//public key hash of the signer that sealed block
+func sealer(block *Block) ([]byte, error) {
+	pubKey, _, err := splitSeal(block.Seal)
+	if err != nil {
+		return nil, err
+	}
+	return wallet.PublicKeyHash(pubKey), nil
+}
+
+func splitSeal(seal []byte) ([]byte, []byte, error) {
+	if len(seal) <= wallet.PublicKeyLen {
+		return nil, nil, errors.New("block has no signer seal")
+	}
+	return seal[:wallet.PublicKeyLen], seal[wallet.PublicKeyLen:], nil
+}
+
+func sortSigners(signers [][]byte) [][]byte {
+	sorted := append([][]byte{}, signers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	return sorted
+}
@@ -2,12 +2,18 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //Steps :
@@ -20,16 +26,36 @@ import (
 const Difficulty = 12 //Determines how difficult to mine block
 // variable in practice
 
+//nonces tried before the coinbase extra-nonce is bumped
+const MaxNonce int64 = math.MaxUint32
+
+//Block.Nonce is an int, which only has 32 bits on some platforms
+const maxIntNonce int64 = 1<<(strconv.IntSize-1) - 1
+
+//how many hashes a worker does between checks for cancellation
+const checkInterval = 1 << 12
+
+var ErrNonceExhausted = errors.New("nonce space exhausted")
+
 type ProofOfWork struct {
-	Block  *Block
-	Target *big.Int
+	Block      *Block
+	Target     *big.Int
+	Difficulty int
+
+	Hashes  uint64        //hashes computed by the last Run
+	Elapsed time.Duration //time taken by the last Run
 }
 
 func Proof(b *Block) *ProofOfWork {
+	return NewProof(b, Difficulty)
+}
+
+//proof of work for b with a hash below 2^(256-difficulty)
+func NewProof(b *Block, difficulty int) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+	target.Lsh(target, uint(256-difficulty))
 
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{Block: b, Target: target, Difficulty: difficulty}
 	return pow
 }
 
@@ -39,41 +65,138 @@ func (pow *ProofOfWork) InitData(nonce int) []byte {
 			pow.Block.PrevHash,
 			pow.Block.HashTransactions(),
 			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
+			ToHex(int64(pow.Difficulty)),
 		},
 		[]byte{},
 	)
 	return data
 }
 
+//header data with the nonce left zeroed, so the Merkle root is computed once
+//returns the data and the offset of the nonce in it
+func (pow *ProofOfWork) headerTemplate() ([]byte, int) {
+	prefix := append(append([]byte{}, pow.Block.PrevHash...), pow.Block.HashTransactions()...)
+	data := bytes.Join([][]byte{prefix, ToHex(0), ToHex(int64(pow.Difficulty))}, []byte{})
+	return data, len(prefix)
+}
+
 func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
+	nonce, hash, err := pow.RunContext(context.Background())
+	Handle(err)
+	return nonce, hash
+}
+
+//mine on runtime.NumCPU() workers until a nonce is found or ctx is done
+//the coinbase extra-nonce is bumped each time the nonce space runs out
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
+	start := time.Now()
+	pow.Hashes = 0
+
+	for extraNonce := uint64(1); ; extraNonce++ {
+		nonce, hash, err := pow.search(ctx)
+		pow.Elapsed = time.Since(start)
+		if err != ErrNonceExhausted {
+			return nonce, hash, err
+		}
+		if !pow.bumpExtraNonce(extraNonce) {
+			return 0, nil, err
+		}
+	}
+}
 
-	nonce := 0
+//hashes per second of the last Run
+func (pow *ProofOfWork) HashRate() float64 {
+	if pow.Elapsed <= 0 {
+		return 0
+	}
+	return float64(pow.Hashes) / pow.Elapsed.Seconds()
+}
 
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
+type powResult struct {
+	nonce int
+	hash  []byte
+}
+
+//try every nonce up to MaxNonce, worker i takes nonces i, i+workers, ...
+func (pow *ProofOfWork) search(ctx context.Context) (int, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	template, offset := pow.headerTemplate()
+	workers := runtime.NumCPU()
+	found := make(chan powResult, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			data := append([]byte{}, template...)
+			var intHash big.Int
+			var hashes uint64
+
+			limit := MaxNonce
+			if limit > maxIntNonce {
+				limit = maxIntNonce
+			}
+			for nonce := int64(first); nonce <= limit; nonce += int64(workers) {
+				if hashes++; hashes%checkInterval == 0 && ctx.Err() != nil {
+					break
+				}
+				binary.BigEndian.PutUint64(data[offset:], uint64(nonce))
+				hash := sha256.Sum256(data)
+				intHash.SetBytes(hash[:])
+
+				if intHash.Cmp(pow.Target) == -1 {
+					found <- powResult{int(nonce), hash[:]}
+					cancel()
+					break
+				}
+			}
+			atomic.AddUint64(&pow.Hashes, hashes)
+		}(i)
+	}
+	wg.Wait()
 
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes(hash[:])
+	select {
+	case res := <-found:
+		return res.nonce, res.hash, nil
+	default:
+	}
+	//ctx is only done here if it was cancelled by the caller
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	return 0, nil, ErrNonceExhausted
+}
 
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
-		}
+//change the coinbase data so the Merkle root, and the nonce space, is fresh
+func (pow *ProofOfWork) bumpExtraNonce(extraNonce uint64) bool {
+	if len(pow.Block.Transactions) == 0 || !pow.Block.Transactions[0].IsCoinBase() {
+		return false
+	}
+	coinbase := pow.Block.Transactions[0]
+	data := coinbase.Inputs[0].PubKey
+	if extraNonce > 1 {
+		data = data[:len(data)-8]
 	}
-	return nonce, hash[:]
+	coinbase.Inputs[0].PubKey = append(append([]byte{}, data...), ToHex(int64(extraNonce))...)
+	coinbase.ID = coinbase.Hash()
+	return true
 }
 
-// Validate the block
+// Validate the block, its hash must be the hash of its contents and meet the target
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 	data := pow.InitData(pow.Block.Nonce)
 
 	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:], pow.Block.Hash) {
+		return false
+	}
 	intHash.SetBytes(hash[:])
 
 	return intHash.Cmp(pow.Target) == -1
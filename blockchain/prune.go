@@ -0,0 +1,107 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+//Prune mode, only the most recent blocks keep their transactions. Older
+//blocks are rewritten as headers, which still carry their Merkle root so
+//their seal can be checked, and lose their undo data. The UTXO set and the
+//indexes are kept. Once enabled the mode stays on, pruned transactions
+//can't be brought back.
+var pruneKey = []byte("prune")
+
+//blocks always kept so recent blocks can still be disconnected
+const MinPruneDepth = 6
+
+var ErrBlockPruned = errors.New("block is pruned, only its header is kept")
+
+func loadPruneDepth(txn *badger.Txn) (int, error) {
+	depth, err := getInt(txn, pruneKey)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	return depth, err
+}
+
+//blocks kept with their transactions, 0 when the chain isn't pruned
+func (chain *Blockchain) PruneDepth() int {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+	return chain.pruneDepth
+}
+
+//turn on prune mode keeping depth blocks, pruning older ones right away
+//returns the number of blocks pruned
+func (chain *Blockchain) EnablePruning(depth int) (int, error) {
+	if depth < MinPruneDepth {
+		return 0, fmt.Errorf("prune depth must be at least %d", MinPruneDepth)
+	}
+	if _, ok := chain.Engine.(PoWEngine); !ok {
+		return 0, errors.New("only proof of work chains can be pruned, signer votes need every block")
+	}
+	chain.writer.Lock()
+	defer chain.writer.Unlock()
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return setInt(txn, pruneKey, depth)
+	})
+	if err != nil {
+		return 0, err
+	}
+	chain.mu.Lock()
+	chain.pruneDepth = depth
+	chain.mu.Unlock()
+	return chain.pruneBlocks()
+}
+
+//rewrite blocks below the prune window as headers, walking back from the
+//tip until a block that is already pruned. The caller holds the writer lock.
+func (chain *Blockchain) pruneBlocks() (int, error) {
+	pruned := 0
+	hash := chain.LastHash()
+	for kept := 0; len(hash) > 0; kept++ {
+		block, err := chain.getBlock(hash)
+		if err != nil {
+			return pruned, err
+		}
+		if block.Pruned() {
+			break
+		}
+		if kept >= chain.pruneDepth {
+			if err := chain.pruneBlock(block); err != nil {
+				return pruned, err
+			}
+			pruned++
+		}
+		hash = block.PrevHash
+	}
+	return pruned, nil
+}
+
+//true when some blocks only have their header, pruned or not yet
+//backfilled below a snapshot
+func (chain *Blockchain) HasPrunedBlocks() bool {
+	return chain.PruneDepth() > 0 || chain.FromSnapshot()
+}
+
+//the block without its transactions
+func (block *Block) header() *Block {
+	header := *block
+	header.MerkleRoot = block.HashTransactions()
+	header.Transactions = nil
+	return &header
+}
+
+func (chain *Blockchain) pruneBlock(block *Block) error {
+	header := block.header()
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(block.Hash, header.Serialize()); err != nil {
+			return err
+		}
+		return txn.Delete(undoEntry(block.Hash))
+	})
+}
@@ -0,0 +1,119 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+//Signature hash types, appended as the last byte of every input signature.
+//They pick which parts of the transaction a signature commits to:
+//	ALL    - every output
+//	NONE   - no output, anyone may change where the tokens go
+//	SINGLE - only the output with the same index as the input
+//	ANYONECANPAY may be OR'ed with any of them to commit to the signed input only,
+//	so more inputs can be added later (e.g. crowdfunding)
+type SigHashType byte
+
+const (
+	SigHashAll          SigHashType = 0x01
+	SigHashNone         SigHashType = 0x02
+	SigHashSingle       SigHashType = 0x03
+	SigHashAnyoneCanPay SigHashType = 0x80
+
+	sigHashMask = 0x1f
+)
+
+//check the hash type is one of the defined combinations
+func (ht SigHashType) IsValid() bool {
+	base := ht &^ SigHashAnyoneCanPay
+	return base >= SigHashAll && base <= SigHashSingle
+}
+
+func (ht SigHashType) base() SigHashType {
+	return ht & sigHashMask
+}
+
+//Digests shared by every input of a transaction, computed once per transaction
+type SigHashCache struct {
+	hashPrevouts []byte
+	hashOutputs  []byte
+}
+
+func NewSigHashCache(tx *Transaction) *SigHashCache {
+	var prevouts bytes.Buffer
+	for _, in := range tx.Inputs {
+		writeOutpoint(&prevouts, in)
+	}
+	var outputs bytes.Buffer
+	for _, out := range tx.Outputs {
+		writeOutput(&outputs, out)
+	}
+
+	hashPrevouts := sha256.Sum256(prevouts.Bytes())
+	hashOutputs := sha256.Sum256(outputs.Bytes())
+	return &SigHashCache{hashPrevouts[:], hashOutputs[:]}
+}
+
+//Message signed by input inIdx spending prevOut. It is the SHA-256 of
+//	hashPrevouts  sha256 of every input outpoint, zeros with ANYONECANPAY
+//	outpoint      txid length (4 bytes), txid, output index (4 bytes)
+//	prevOut       the spent output
+//	hashOutputs   sha256 of the outputs committed to by the hash type, zeros with NONE
+//	hashType      1 byte
+//where outputs are encoded as value (8 bytes), then length prefixed
+//public key hash and data, lengths being 4 bytes and everything big endian
+func (tx *Transaction) SignatureHash(cache *SigHashCache, inIdx int, prevOut TxOutput, hashType SigHashType) ([]byte, error) {
+	if !hashType.IsValid() {
+		return nil, errors.New("unknown signature hash type")
+	}
+	if inIdx < 0 || inIdx >= len(tx.Inputs) {
+		return nil, errors.New("input index out of range")
+	}
+	zero := make([]byte, sha256.Size)
+
+	var msg bytes.Buffer
+	if hashType&SigHashAnyoneCanPay != 0 {
+		msg.Write(zero)
+	} else {
+		msg.Write(cache.hashPrevouts)
+	}
+	writeOutpoint(&msg, tx.Inputs[inIdx])
+	writeOutput(&msg, prevOut)
+
+	switch hashType.base() {
+	case SigHashAll:
+		msg.Write(cache.hashOutputs)
+	case SigHashNone:
+		msg.Write(zero)
+	case SigHashSingle:
+		if inIdx >= len(tx.Outputs) {
+			return nil, errors.New("SIGHASH_SINGLE without a matching output")
+		}
+		var out bytes.Buffer
+		writeOutput(&out, tx.Outputs[inIdx])
+		hashOutput := sha256.Sum256(out.Bytes())
+		msg.Write(hashOutput[:])
+	}
+	msg.WriteByte(byte(hashType))
+
+	hash := sha256.Sum256(msg.Bytes())
+	return hash[:], nil
+}
+
+func writeOutpoint(buf *bytes.Buffer, in TxInput) {
+	writeBytes(buf, in.ID)
+	binary.Write(buf, binary.BigEndian, int32(in.Out))
+}
+
+func writeOutput(buf *bytes.Buffer, out TxOutput) {
+	binary.Write(buf, binary.BigEndian, int64(out.Value))
+	writeBytes(buf, out.PubKeyHash)
+	writeBytes(buf, out.Data)
+}
+
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+}
@@ -0,0 +1,702 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+//UTXO set snapshots, the unspent outputs at a tip so a node can start from
+//them instead of replaying every block. A snapshot holds the headers of
+//the chain, so the tip is checked back to genesis, then the utxo- entries
+//in key order. Its hash commits to the tip, height and entries and must
+//match a trusted value to be loaded. A loaded chain keeps only headers
+//below the tip until a backfill brings the blocks back and checks them
+//against the snapshot.
+var (
+	snapshotMagic = []byte("utxosnap")
+	//tip hash, height and hash of the snapshot a chain was loaded from,
+	//removed once the blocks below it are backfilled
+	snapshotKey = []byte("snapshot")
+)
+
+const snapshotVersion = 1
+
+//where a snapshot is loaded before the database is moved to dbPath
+const snapshotLoadPath = "./tmp/blocks.load"
+
+type SnapshotInfo struct {
+	TipHash []byte
+	Height  int
+	Entries int //transactions with unspent outputs
+	Hash    []byte
+}
+
+type snapshotHasher struct {
+	h hash.Hash
+}
+
+func newSnapshotHasher(tipHash []byte, height int) *snapshotHasher {
+	s := &snapshotHasher{sha256.New()}
+	enc := encoder{}
+	enc.bytes(tipHash)
+	enc.uvarint(uint64(height))
+	s.h.Write(enc.buf.Bytes())
+	return s
+}
+
+func (s *snapshotHasher) add(txID, outs []byte) {
+	s.h.Write(snapshotEntry(txID, outs))
+}
+
+func (s *snapshotHasher) sum() []byte {
+	return s.h.Sum(nil)
+}
+
+func snapshotEntry(txID, outs []byte) []byte {
+	enc := encoder{}
+	enc.bytes(txID)
+	enc.bytes(outs)
+	return enc.buf.Bytes()
+}
+
+//write the UTXO set and the headers of the chain to w, all read from one
+//consistent view of the database
+func (chain *Blockchain) DumpUTXO(w io.Writer) (SnapshotInfo, error) {
+	var info SnapshotInfo
+	bw := bufio.NewWriter(w)
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		if info.TipHash, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+		headers, err := chainHeaders(txn, info.TipHash)
+		if err != nil {
+			return err
+		}
+		info.Height = len(headers) - 1
+
+		//the hash goes first, so the entries are read twice
+		hasher := newSnapshotHasher(info.TipHash, info.Height)
+		err = forEachUTXO(txn, func(txID, outs []byte) error {
+			hasher.add(txID, outs)
+			info.Entries++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		info.Hash = hasher.sum()
+
+		enc := encoder{}
+		enc.uvarint(snapshotVersion)
+		enc.bytes(encodeEngine(chain.Engine))
+		enc.bytes(info.TipHash)
+		enc.uvarint(uint64(info.Height))
+		enc.uvarint(uint64(info.Entries))
+		enc.bytes(info.Hash)
+		if _, err := bw.Write(snapshotMagic); err != nil {
+			return err
+		}
+		if err := writeRecord(bw, enc.buf.Bytes()); err != nil {
+			return err
+		}
+		for _, header := range headers {
+			if err := writeRecord(bw, header.Serialize()); err != nil {
+				return err
+			}
+		}
+		return forEachUTXO(txn, func(txID, outs []byte) error {
+			return writeRecord(bw, snapshotEntry(txID, outs))
+		})
+	})
+	if err != nil {
+		return info, err
+	}
+	return info, bw.Flush()
+}
+
+//headers from genesis to tipHash
+func chainHeaders(txn *badger.Txn, tipHash []byte) ([]*Block, error) {
+	var headers []*Block
+	for hash := tipHash; len(hash) > 0; {
+		item, err := txn.Get(hash)
+		if err != nil {
+			return nil, err
+		}
+		value, err := item.Value()
+		if err != nil {
+			return nil, err
+		}
+		block := Deserialize(value)
+		headers = append(headers, block.header())
+		hash = block.PrevHash
+	}
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+	return headers, nil
+}
+
+//utxo- entries in key order, outputs in their canonical encoding
+func forEachUTXO(txn *badger.Txn, fn func(txID, outs []byte) error) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+		value, err := it.Item().Value()
+		if err != nil {
+			return err
+		}
+		outs, err := decodeOutputs(value)
+		if err != nil {
+			return err
+		}
+		if err := fn(it.Item().KeyCopy(nil)[prefixLength:], outs.SerializeOutputs()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//create a new chain from a snapshot written by DumpUTXO whose hash is
+//trusted. The headers are checked back to genesis and the entries against
+//the hash; nothing is kept when a check fails.
+func LoadUTXO(r io.Reader, trusted []byte) (*Blockchain, SnapshotInfo, error) {
+	var info SnapshotInfo
+	if DBexists() {
+		return nil, info, errors.New("blockchain already exists")
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return nil, info, errors.New("not a UTXO snapshot")
+	}
+	record, err := readRecord(br)
+	if err != nil {
+		return nil, info, fmt.Errorf("reading header: %v", err)
+	}
+	dec := newDecoder(record)
+	dec.version(snapshotVersion)
+	encodedEngine := dec.bytes()
+	info.TipHash = dec.bytes()
+	info.Height = int(dec.uvarint())
+	info.Entries = int(dec.uvarint())
+	info.Hash = dec.bytes()
+	if err := dec.finish(); err != nil {
+		return nil, info, fmt.Errorf("reading header: %v", err)
+	}
+	if !bytes.Equal(info.Hash, trusted) {
+		return nil, info, fmt.Errorf("snapshot hash %x is not the trusted %x", info.Hash, trusted)
+	}
+	engine, err := decodeEngine(encodedEngine)
+	if err != nil {
+		return nil, info, err
+	}
+	if _, ok := engine.(PoWEngine); !ok {
+		return nil, info, errors.New("only proof of work chains can start from a snapshot, signer votes need every block")
+	}
+
+	headers, err := readHeaders(br, engine, info)
+	if err != nil {
+		return nil, info, err
+	}
+
+	//the database only moves to dbPath once complete, so an interrupted
+	//load leaves no chain behind and the next one starts over
+	if err := os.RemoveAll(snapshotLoadPath); err != nil {
+		return nil, info, err
+	}
+	db, err := openDBAt(snapshotLoadPath)
+	if err != nil {
+		return nil, info, err
+	}
+	chain := &Blockchain{Database: db, Engine: engine}
+	err = chain.loadSnapshot(br, headers, info)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		//DBexists only looks for the manifest, clear anything else first
+		if err = os.RemoveAll(dbPath); err == nil {
+			err = os.Rename(snapshotLoadPath, dbPath)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(snapshotLoadPath)
+		return nil, info, err
+	}
+
+	if chain.Database, err = openDB(); err != nil {
+		return nil, info, err
+	}
+	return chain, info, nil
+}
+
+//headers from genesis to the tip of the snapshot, each sealed and linked
+//to the one before
+func readHeaders(br *bufio.Reader, engine ConsensusEngine, info SnapshotInfo) ([]*Block, error) {
+	var headers []*Block
+	var prevHash []byte
+	for height := 0; height <= info.Height; height++ {
+		header, err := readBlock(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading header %d: %v", height, err)
+		}
+		if !header.Pruned() || !bytes.Equal(header.PrevHash, prevHash) {
+			return nil, fmt.Errorf("header %d doesn't follow header %d", height, height-1)
+		}
+		if err := engine.VerifySeal(nil, header); err != nil {
+			return nil, fmt.Errorf("header %d: %v", height, err)
+		}
+		headers = append(headers, header)
+		prevHash = header.Hash
+	}
+	if !bytes.Equal(prevHash, info.TipHash) {
+		return nil, errors.New("headers don't end at the snapshot tip")
+	}
+	return headers, nil
+}
+
+func (chain *Blockchain) loadSnapshot(br *bufio.Reader, headers []*Block, info SnapshotInfo) error {
+	w := newEntryWriter(chain.Database)
+	defer w.discard()
+
+	schema := encoder{}
+	schema.varint(int64(SchemaVersion))
+	entries := []dbEntry{
+		{schemaKey, schema.buf.Bytes()},
+		{consensusKey, encodeEngine(chain.Engine)},
+		{snapshotKey, encodeSnapshotKey(info)},
+		{utxoTipKey, info.TipHash},
+		{[]byte("lh"), info.TipHash},
+	}
+	for _, header := range headers {
+		entries = append(entries, dbEntry{header.Hash, header.Serialize()})
+	}
+	for _, entry := range entries {
+		if err := w.set(entry.key, entry.value); err != nil {
+			return err
+		}
+	}
+
+	//entries are written as they are read, a mismatch with the hash
+	//discards the whole database
+	hasher := newSnapshotHasher(info.TipHash, info.Height)
+	delta := newUTXODelta()
+	for n := 0; n < info.Entries; n++ {
+		record, err := readRecord(br)
+		if err != nil {
+			return fmt.Errorf("reading entry %d: %v", n, err)
+		}
+		dec := newDecoder(record)
+		txID := dec.bytes()
+		outs := dec.bytes()
+		if err := dec.finish(); err != nil {
+			return fmt.Errorf("reading entry %d: %v", n, err)
+		}
+		decoded, err := decodeOutputs(outs)
+		if err != nil {
+			return fmt.Errorf("reading entry %d: %v", n, err)
+		}
+		delta.addOutputs(txID, decoded)
+		hasher.add(txID, outs)
+		if err := w.set(append(append([]byte{}, utxoPrefix...), txID...), outs); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(hasher.sum(), info.Hash) {
+		return errors.New("snapshot entries don't match its hash")
+	}
+	stats := newUTXOStats()
+	stats.apply(delta)
+	if err := w.set(utxoStatsKey, stats.encode()); err != nil {
+		return err
+	}
+	if err := w.commit(); err != nil {
+		return err
+	}
+	chain.setTip(info.TipHash)
+	chain.snapshotTip = info.TipHash
+	return nil
+}
+
+func encodeSnapshotKey(info SnapshotInfo) []byte {
+	enc := encoder{}
+	enc.bytes(info.TipHash)
+	enc.uvarint(uint64(info.Height))
+	enc.bytes(info.Hash)
+	return enc.buf.Bytes()
+}
+
+//the snapshot the chain was loaded from, nil when it was not or the
+//blocks below it are backfilled
+func loadSnapshotInfo(txn *badger.Txn) (*SnapshotInfo, error) {
+	item, err := txn.Get(snapshotKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+	var info SnapshotInfo
+	dec := newDecoder(value)
+	info.TipHash = dec.bytes()
+	info.Height = int(dec.uvarint())
+	info.Hash = dec.bytes()
+	return &info, dec.finish()
+}
+
+//true while the chain runs on a snapshot whose blocks aren't backfilled
+func (chain *Blockchain) FromSnapshot() bool {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+	return chain.snapshotTip != nil
+}
+
+//Background backfill, restoring the blocks below the snapshot tip from a
+//chain file written by ExportChain in a process of its own. The worker
+//holds the database for short batches only, so other commands get it in
+//between while openDB waits for it. Every block must match its header and
+//is fully validated while the UTXO set is rebuilt in memory; the blocks
+//are staged under backfillPrefix and only moved over their headers once
+//the rebuilt set hashes to the snapshot hash, then the chain stops
+//depending on the snapshot.
+var backfillPrefix = []byte("backfill-")
+
+const (
+	//hidden command running the worker
+	BackfillCommand = "backfillworker"
+	//output of the worker
+	BackfillLog     = "./tmp/backfill.log"
+	backfillPidFile = "./tmp/backfill.pid"
+	//time a batch holds the database, and the pause after it
+	backfillBatch = time.Second
+	backfillPause = 500 * time.Millisecond
+)
+
+//start a worker restoring the blocks of the chain file blocks
+func StartBackfill(blocks string) error {
+	if pid, err := runningBackfill(); err != nil {
+		return err
+	} else if pid != 0 {
+		return fmt.Errorf("a backfill is already running in process %d", pid)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	log, err := os.OpenFile(BackfillLog, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	worker := exec.Command(exe, BackfillCommand, "-blocks", blocks)
+	worker.Stdout = log
+	worker.Stderr = log
+	if err := worker.Start(); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(backfillPidFile, []byte(strconv.Itoa(worker.Process.Pid)), 0600); err != nil {
+		return err
+	}
+	return worker.Process.Release()
+}
+
+//process id of the running worker, 0 when there is none
+func runningBackfill() (int, error) {
+	data, err := ioutil.ReadFile(backfillPidFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, nil
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil || process.Signal(syscall.Signal(0)) != nil {
+		return 0, nil
+	}
+	return pid, nil
+}
+
+//restore the blocks of the chain file blocks a batch at a time, run by the
+//process StartBackfill starts
+func RunBackfill(blocks string) error {
+	defer os.Remove(backfillPidFile)
+	f, err := os.Open(blocks)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var bf *backfill
+	for {
+		chain, err := openChain()
+		if dbLocked(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if bf == nil {
+			bf, err = chain.newBackfill(f)
+		}
+		done := false
+		if err == nil {
+			done, err = bf.run(chain, time.Now().Add(backfillBatch))
+		}
+		chain.Database.Close()
+		if err != nil || done {
+			return err
+		}
+		fmt.Printf("Backfilled up to height %d of %d\n", bf.height-1, bf.info.Height)
+		time.Sleep(backfillPause)
+	}
+}
+
+//progress of a backfill between batches
+type backfill struct {
+	info   *SnapshotInfo
+	br     *bufio.Reader
+	UTXO   memoryUTXO
+	height int //next block to restore
+}
+
+func (chain *Blockchain) newBackfill(r io.Reader) (*backfill, error) {
+	var info *SnapshotInfo
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		info, err = loadSnapshotInfo(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, errors.New("the chain wasn't loaded from a snapshot or is already backfilled")
+	}
+
+	br, engine, err := openChainFile(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(encodeEngine(engine), encodeEngine(chain.Engine)) {
+		return nil, errors.New("the chain file is of another chain")
+	}
+	//blocks staged by an interrupted backfill
+	(&UTXOSet{chain}).DeleteByPrefix(backfillPrefix)
+	return &backfill{info: info, br: br, UTXO: make(memoryUTXO)}, nil
+}
+
+//restore blocks until deadline passes, staging them, and finish the
+//backfill once the snapshot tip is reached. Returns true when finished.
+func (bf *backfill) run(chain *Blockchain, deadline time.Time) (bool, error) {
+	var staged []dbEntry
+	for bf.height <= bf.info.Height && time.Now().Before(deadline) {
+		block, err := readBlock(bf.br)
+		if err == io.EOF {
+			return false, fmt.Errorf("chain file ends at height %d, before the snapshot tip at %d", bf.height-1, bf.info.Height)
+		}
+		if err != nil {
+			return false, err
+		}
+		entry, err := chain.backfillBlock(block, bf.UTXO)
+		if err != nil {
+			return false, fmt.Errorf("block %d: %v", bf.height, err)
+		}
+		if entry != nil {
+			staged = append(staged, *entry)
+		}
+		bf.height++
+	}
+	if err := writeEntries(chain.Database, staged); err != nil {
+		return false, err
+	}
+	if bf.height <= bf.info.Height {
+		return false, nil
+	}
+	return true, chain.finishBackfill(bf)
+}
+
+//check the rebuilt UTXO set against the snapshot hash, then move the
+//staged blocks over their headers
+func (chain *Blockchain) finishBackfill(bf *backfill) error {
+	var keys []string
+	for key := range bf.UTXO {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hasher := newSnapshotHasher(bf.info.TipHash, bf.info.Height)
+	for _, key := range keys {
+		txID, _ := hex.DecodeString(key)
+		hasher.add(txID, bf.UTXO[key].SerializeOutputs())
+	}
+	if !bytes.Equal(hasher.sum(), bf.info.Hash) {
+		(&UTXOSet{chain}).DeleteByPrefix(backfillPrefix)
+		return errors.New("the blocks don't produce the UTXO set of the snapshot")
+	}
+
+	var blocks []dbEntry
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(backfillPrefix); it.ValidForPrefix(backfillPrefix); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, dbEntry{it.Item().KeyCopy(nil)[len(backfillPrefix):], value})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	//an interruption from here on leaves validated blocks in place, the
+	//next backfill finds them restored already
+	if err := writeEntries(chain.Database, blocks); err != nil {
+		return err
+	}
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(snapshotKey)
+	})
+	if err != nil {
+		return err
+	}
+	(&UTXOSet{chain}).DeleteByPrefix(backfillPrefix)
+	chain.mu.Lock()
+	chain.snapshotTip = nil
+	chain.mu.Unlock()
+	return nil
+}
+
+//check block against its header and the UTXO set rebuilt so far, which it
+//then updates. Returns the staging entry of a block stored as a header.
+func (chain *Blockchain) backfillBlock(block *Block, UTXO memoryUTXO) (*dbEntry, error) {
+	if block.MerkleRoot != nil {
+		return nil, errStoredMerkleRoot
+	}
+	stored, err := chain.getBlock(block.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("%x isn't a block of the chain: %v", block.Hash, err)
+	}
+	if !bytes.Equal(stored.PrevHash, block.PrevHash) || !bytes.Equal(stored.HashTransactions(), block.HashTransactions()) {
+		return nil, fmt.Errorf("block %x doesn't match its header", block.Hash)
+	}
+	if err := chain.Engine.VerifySeal(chain, block); err != nil {
+		return nil, err
+	}
+	if len(block.Transactions) == 0 {
+		return nil, errors.New("block has no transactions")
+	}
+
+	created := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	fees := 0
+	for pos, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, block.txID(tx)) {
+			return nil, fmt.Errorf("transaction %x: id doesn't match its contents", tx.ID)
+		}
+		if tx.IsCoinBase() {
+			if pos != 0 {
+				return nil, fmt.Errorf("transaction %x: coinbase must be the first transaction", tx.ID)
+			}
+		} else {
+			fee, err := chain.checkInputs(UTXO, block, tx, created, spent)
+			if err != nil {
+				return nil, fmt.Errorf("transaction %x: %v", tx.ID, err)
+			}
+			var ok bool
+			if fees, ok = addValues(fees, fee); !ok {
+				return nil, errors.New("fees overflow")
+			}
+		}
+		created[hex.EncodeToString(tx.ID)] = *tx
+	}
+	if coinbase := block.Transactions[0]; coinbase.IsCoinBase() {
+		if err := checkCoinbase(coinbase, fees); err != nil {
+			return nil, fmt.Errorf("transaction %x: %v", coinbase.ID, err)
+		}
+	}
+	UTXO.apply(block)
+
+	if !stored.Pruned() {
+		return nil, nil
+	}
+	return &dbEntry{append(append([]byte{}, backfillPrefix...), block.Hash...), block.Serialize()}, nil
+}
+
+//UTXO set rebuilt in memory, keyed by hex txid
+type memoryUTXO map[string]TxOutputs
+
+func (UTXO memoryUTXO) FindOutput(txID []byte, index int) (TxOutput, bool) {
+	outs := UTXO[hex.EncodeToString(txID)]
+	for i, out := range outs.Outputs {
+		if outs.Index(i) == index {
+			return out, true
+		}
+	}
+	return TxOutput{}, false
+}
+
+//spend the inputs of block and add its outputs
+func (UTXO memoryUTXO) apply(block *Block) {
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinBase() {
+			for _, in := range tx.Inputs {
+				key := hex.EncodeToString(in.ID)
+				outs := UTXO[key]
+				remaining := TxOutputs{}
+				for i, out := range outs.Outputs {
+					if idx := outs.Index(i); idx != in.Out {
+						remaining.Add(idx, out)
+					}
+				}
+				if len(remaining.Outputs) == 0 {
+					delete(UTXO, key)
+				} else {
+					UTXO[key] = remaining
+				}
+			}
+		}
+
+		outs := TxOutputs{}
+		for idx, out := range tx.Outputs {
+			if !out.IsData() {
+				outs.Add(idx, out)
+			}
+		}
+		if len(outs.Outputs) > 0 {
+			UTXO[hex.EncodeToString(tx.ID)] = outs
+		}
+	}
+}
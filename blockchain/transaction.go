@@ -3,14 +3,13 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 
 	"github.com/shraddha0602/blockchain-implementation/wallet"
@@ -23,10 +22,51 @@ type Transaction struct {
 }
 
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	enc := encoder{}
+	enc.uvarint(serializationVersion)
+	enc.transaction(&tx)
+	return enc.buf.Bytes()
+}
+
+func DeserializeTransaction(data []byte) Transaction {
+	dec := newDecoder(data)
+	dec.version(serializationVersion)
+	tx := dec.transaction()
+	Handle(dec.finish())
+	return *tx
+}
+
+//gob encoding that transactions of legacy blocks were hashed with
+//gob writes the fields of each type into the stream, so it encodes the
+//types as they were before outputs could carry data
+func (tx Transaction) legacySerialize() []byte {
+	type TxInput struct {
+		ID        []byte
+		Out       int
+		Signature []byte
+		PubKey    []byte
+	}
+	type TxOutput struct {
+		Value      int
+		PubKeyHash []byte
+	}
+	type Transaction struct {
+		ID      []byte
+		Inputs  []TxInput
+		Outputs []TxOutput
+	}
 
+	legacy := Transaction{ID: tx.ID}
+	for _, in := range tx.Inputs {
+		legacy.Inputs = append(legacy.Inputs, TxInput{in.ID, in.Out, in.Signature, in.PubKey})
+	}
+	for _, out := range tx.Outputs {
+		legacy.Outputs = append(legacy.Outputs, TxOutput{out.Value, out.PubKeyHash})
+	}
+
+	var encoded bytes.Buffer
 	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(tx)
+	err := encode.Encode(legacy)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -44,6 +84,9 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
+//coins a coinbase creates on top of the fees of its block
+const subsidy = 25
+
 //transaction if genesis block
 func CoinbaseTx(to, data string) *Transaction {
 	if data == "" {
@@ -53,7 +96,7 @@ func CoinbaseTx(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(25, to)
+	txout := NewTXOutput(subsidy, to)
 
 	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
 	tx.ID = tx.Hash()
@@ -61,76 +104,175 @@ func CoinbaseTx(to, data string) *Transaction {
 	return &tx
 }
 
+//coinbase transaction that also embeds data, used for notarization
+func NotaryTx(to string, data []byte) (*Transaction, error) {
+	return coinbaseDataTx(to, data)
+}
+
+func coinbaseDataTx(to string, data []byte) (*Transaction, error) {
+	dataOut, err := NewDataOutput(data)
+	if err != nil {
+		return nil, err
+	}
+	tx := CoinbaseTx(to, "")
+	tx.Outputs = append(tx.Outputs, *dataOut)
+	tx.ID = tx.Hash()
+
+	return tx, nil
+}
+
+//check if the transaction carries the given data
+func (tx *Transaction) HasData(data []byte) bool {
+	for _, out := range tx.Outputs {
+		if out.IsData() && bytes.Equal(out.Data, data) {
+			return true
+		}
+	}
+	return false
+}
+
 //check if genesis block in transaction
 func (tx *Transaction) IsCoinBase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-func NewTransactions(from, to string, amount int, UTXO *UTXOSet) *Transaction {
+//amount paid to an address
+type Payment struct {
+	To     string
+	Amount int
+}
+
+func NewTransactions(from, to string, amount int, UTXO *UTXOSet, control CoinControl) (*Transaction, error) {
+	return NewTransactionMany(from, []Payment{{to, amount}}, UTXO, control)
+}
+
+//total of payments, which must each pay a positive amount to a valid
+//address no other payment pays
+func checkPayments(payments []Payment) (int, error) {
+	if len(payments) == 0 {
+		return 0, errors.New("no payments to send")
+	}
+	total := 0
+	paid := make(map[string]bool)
+	for _, payment := range payments {
+		pubKeyHash, err := wallet.AddressPubKeyHash(payment.To)
+		if err != nil {
+			return 0, fmt.Errorf("payment to %q: %w", payment.To, err)
+		}
+		if payment.Amount <= 0 {
+			return 0, fmt.Errorf("payment to %s: amount must be positive", payment.To)
+		}
+		if paid[string(pubKeyHash)] {
+			return 0, fmt.Errorf("payment to %s: address is paid more than once", payment.To)
+		}
+		paid[string(pubKeyHash)] = true
+
+		var ok bool
+		if total, ok = addValues(total, payment.Amount); !ok {
+			return 0, errors.New("total of the payments is too large")
+		}
+	}
+	return total, nil
+}
+
+//one transaction paying every payment with a single change output
+//fails with wallet.ErrWalletLocked when from's key is encrypted and locked
+//and with ErrInsufficientFunds when the chosen outputs don't cover the total
+func NewTransactionMany(from string, payments []Payment, UTXO *UTXOSet, control CoinControl) (*Transaction, error) {
 	var ins []TxInput
 	var outs []TxOutput
 
+	amount, err := checkPayments(payments)
+	if err != nil {
+		return nil, err
+	}
+
 	wallets, err := wallet.CreateWallets()
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := wallets.PrivateKey(from)
+	if err != nil {
+		return nil, err
+	}
 	w := wallets.GetWallet(from)
 	publicKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	acc, validOuts := UTXO.FindSpendableOutput(publicKeyHash, amount)
-
-	if acc > amount {
-		log.Panic("Error : insufficient balance")
+	selected, err := control.selectCoins(UTXO, publicKeyHash, amount)
+	if err != nil {
+		return nil, err
 	}
 
-	for txID, outputs := range validOuts {
-		txid, err := hex.DecodeString(txID)
-		Handle(err)
-
-		for _, output := range outputs {
-			input := TxInput{txid, output, nil, w.PublicKey}
-			ins = append(ins, input)
-		}
+	acc := 0
+	for _, utxo := range selected {
+		input := TxInput{utxo.TxID, utxo.Index, nil, w.PublicKey}
+		ins = append(ins, input)
+		acc += utxo.Value
 	}
 
-	outs = append(outs, *NewTXOutput(amount, to))
+	for _, payment := range payments {
+		outs = append(outs, *NewTXOutput(payment.Amount, payment.To))
+	}
 	if acc > amount {
-		outs = append(outs, *NewTXOutput(acc-amount, from))
+		//HD wallets send change to a fresh address
+		change := from
+		if wallets.IsHD() {
+			if change, err = wallets.NewAddress(wallet.ChangeChain); err != nil {
+				return nil, err
+			}
+			wallets.SaveFile()
+		}
+		outs = append(outs, *NewTXOutput(acc-amount, change))
 	}
 
 	tx := Transaction{nil, ins, outs}
 	tx.ID = tx.Hash()
-	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
+	UTXO.Blockchain.SignTransaction(&tx, privateKey)
 
-	return &tx
+	return &tx, nil
 }
 
-//sign the transaction
-func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTransac map[string]Transaction) {
+//sign every input of the transaction with hashType
+func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTransac map[string]Transaction, hashType SigHashType) {
 	if tx.IsCoinBase() {
 		return
 	}
 
+	prevOuts := make(map[string]TxOutput)
 	for _, in := range tx.Inputs {
-		if prevTransac[hex.EncodeToString(in.ID)].ID == nil {
+		prevTx := prevTransac[hex.EncodeToString(in.ID)]
+		if prevTx.ID == nil {
 			log.Panic("ERROR : Previous transaction doesn't exist")
 		}
+		prevOuts[outpointKey(in.ID, in.Out)] = prevTx.Outputs[in.Out]
 	}
+	tx.signOutputs(privateKey, prevOuts, hashType)
+}
 
-	txCopy := tx.TrimmedCopy()
-
-	for inId, in := range txCopy.Inputs {
-		prevTx := prevTransac[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
-
-		r, s, err := ecdsa.Sign(rand.Reader, &privateKey, txCopy.ID)
-		Handle(err)
-		sign := append(r.Bytes(), s.Bytes()...)
+//sign every input given the outputs they spend, keyed by outpointKey
+func (tx *Transaction) signOutputs(privateKey ecdsa.PrivateKey, prevOuts map[string]TxOutput, hashType SigHashType) {
+	cache := NewSigHashCache(tx)
+	for inId, in := range tx.Inputs {
+		tx.signInput(cache, inId, privateKey, prevOuts[outpointKey(in.ID, in.Out)], hashType)
+	}
+}
 
-		tx.Inputs[inId].Signature = sign
+//sign a single input, e.g. one added after others were signed with ANYONECANPAY
+func (tx *Transaction) SignInput(inIdx int, privateKey ecdsa.PrivateKey, prevTx Transaction, hashType SigHashType) {
+	in := tx.Inputs[inIdx]
+	if !bytes.Equal(prevTx.ID, in.ID) {
+		log.Panic("ERROR : Previous transaction doesn't match input")
 	}
+	tx.signInput(NewSigHashCache(tx), inIdx, privateKey, prevTx.Outputs[in.Out], hashType)
+}
 
+func (tx *Transaction) signInput(cache *SigHashCache, inIdx int, privateKey ecdsa.PrivateKey, prevOut TxOutput, hashType SigHashType) {
+	hash, err := tx.SignatureHash(cache, inIdx, prevOut, hashType)
+	Handle(err)
+	sign, err := wallet.Sign(&privateKey, hash)
+	Handle(err)
+
+	tx.Inputs[inIdx].Signature = append(sign, byte(hashType))
 }
 
 //creating transaction copy
@@ -143,7 +285,7 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash, out.Data})
 	}
 
 	txCopy := Transaction{tx.ID, inputs, outputs}
@@ -156,36 +298,73 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		return true
 	}
 
+	prevOuts := make(map[string]TxOutput)
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
+		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTx.ID == nil {
 			log.Panic("Previous transaction doesn't exists!!")
 		}
+		if in.Out < 0 || in.Out >= len(prevTx.Outputs) || prevTx.Outputs[in.Out].IsData() {
+			return false
+		}
+		prevOuts[outpointKey(in.ID, in.Out)] = prevTx.Outputs[in.Out]
 	}
+	return tx.verifyOutputs(prevOuts)
+}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
+//check the signature of every input given the outputs they spend, keyed
+//by outpointKey
+func (tx *Transaction) verifyOutputs(prevOuts map[string]TxOutput) bool {
+	if tx.IsCoinBase() {
+		return true
+	}
+	cache := NewSigHashCache(tx)
 
 	for inId, in := range tx.Inputs {
-		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
+		prevOut, ok := prevOuts[outpointKey(in.ID, in.Out)]
+		if !ok || prevOut.IsData() {
+			return false
+		}
+		if !in.UsesKey(prevOut.PubKeyHash) || len(in.Signature) == 0 {
+			return false
+		}
+		sign := in.Signature[:len(in.Signature)-1]
+		hashType := SigHashType(in.Signature[len(in.Signature)-1])
+
+		hash, err := tx.SignatureHash(cache, inId, prevOut, hashType)
+		if err != nil {
+			return false
+		}
+		if !wallet.VerifySignature(in.PubKey, hash, sign) {
+			return false
+		}
+	}
+	return true
+}
 
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
+//check the r||s signatures of a legacy transaction, each input signed the
+//gob hash of the transaction with its signatures and public keys removed
+//and the public key hash of the output it spends in place of its own key
+func (tx *Transaction) verifyLegacyOutputs(prevOuts map[string]TxOutput) bool {
+	if tx.IsCoinBase() {
+		return true
+	}
+	txCopy := tx.TrimmedCopy()
+	txCopy.ID = nil
 
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
+	for inId, in := range tx.Inputs {
+		prevOut, ok := prevOuts[outpointKey(in.ID, in.Out)]
+		if !ok || prevOut.IsData() {
+			return false
+		}
+		if !in.UsesKey(prevOut.PubKeyHash) {
+			return false
+		}
+		txCopy.Inputs[inId].PubKey = prevOut.PubKeyHash
+		hash := sha256.Sum256(txCopy.legacySerialize())
+		txCopy.Inputs[inId].PubKey = nil
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
+		if !wallet.VerifyLegacySignature(in.PubKey, hash[:], in.Signature) {
 			return false
 		}
 	}
@@ -207,6 +386,10 @@ func (tx Transaction) String() string {
 
 	for i, output := range tx.Outputs {
 		transac = append(transac, fmt.Sprintf("  Output : %d", i))
+		if output.IsData() {
+			transac = append(transac, fmt.Sprintf("  Data   : %x", output.Data))
+			continue
+		}
 		transac = append(transac, fmt.Sprintf("  Value  : %d", output.Value))
 		transac = append(transac, fmt.Sprintf("  Script : %d", output.PubKeyHash))
 	}
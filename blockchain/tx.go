@@ -3,13 +3,30 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"strconv"
 
 	"github.com/shraddha0602/blockchain-implementation/wallet"
 )
 
+//maximum number of bytes a data output can carry
+const MaxDataSize = 80
+
+//largest total of values, sums of output values must stay below it
+const maxValue = 1<<(strconv.IntSize-1) - 1
+
+//sum of the non-negative values a and b, false when it overflows
+func addValues(a, b int) (int, bool) {
+	if b > maxValue-a {
+		return 0, false
+	}
+	return a + b, true
+}
+
 type TxOutput struct {
 	Value      int    //Value in tokens
 	PubKeyHash []byte // to unlock tokens in Value
+	Data       []byte // arbitrary payload, makes the output unspendable
 }
 
 //references to prev output
@@ -22,15 +39,27 @@ type TxInput struct {
 
 type TxOutputs struct {
 	Outputs []TxOutput
+	Indexes []int //position of each output in its transaction
 }
 
 func NewTXOutput(value int, address string) *TxOutput {
-	txo := &TxOutput{value, nil}
+	txo := &TxOutput{value, nil, nil}
 	txo.Lock([]byte(address))
 
 	return txo
 }
 
+//create a provably unspendable output carrying data
+func NewDataOutput(data []byte) (*TxOutput, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data output can't be empty")
+	}
+	if len(data) > MaxDataSize {
+		return nil, errors.New("data output exceeds maximum size")
+	}
+	return &TxOutput{0, nil, data}, nil
+}
+
 //unlock input
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 	lockingHash := wallet.PublicKeyHash(in.PubKey)
@@ -38,33 +67,77 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
-//lock the output
+//lock the output to a Base58Check or Bech32 address
 func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	// remove version and checksum
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	pubKeyHash, err := wallet.AddressPubKeyHash(string(address))
+	Handle(err)
 	out.PubKeyHash = pubKeyHash
 }
 
 //checks to see if the o/p is locked with Public Key
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	return !out.IsData() && bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+}
+
+//data outputs can never be spent and are kept out of the UTXO set
+func (out *TxOutput) IsData() bool {
+	return len(out.Data) > 0
+}
+
+//add an output along with its index in the transaction
+func (outputs *TxOutputs) Add(idx int, out TxOutput) {
+	if outputs.Indexes == nil {
+		for i := range outputs.Outputs {
+			outputs.Indexes = append(outputs.Indexes, i)
+		}
+	}
+	outputs.Outputs = append(outputs.Outputs, out)
+	outputs.Indexes = append(outputs.Indexes, idx)
+}
+
+//index in the transaction of the i-th stored output
+//sets written before indexes were stored are positional
+func (outputs TxOutputs) Index(i int) int {
+	if outputs.Indexes == nil {
+		return i
+	}
+	return outputs.Indexes[i]
 }
 
 //Serialize Outputs
 func (outputs TxOutputs) SerializeOutputs() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outputs)
-	Handle(err)
-	return buffer.Bytes()
+	enc := encoder{}
+	enc.uvarint(serializationVersion)
+	enc.uvarint(uint64(len(outputs.Outputs)))
+	for i, out := range outputs.Outputs {
+		enc.uvarint(uint64(outputs.Index(i)))
+		enc.output(out)
+	}
+	return enc.buf.Bytes()
 }
 
 //Deserialize Outputs
 func DeserializeOutputs(outputs []byte) TxOutputs {
+	outs, err := decodeOutputs(outputs)
+	Handle(err)
+	return outs
+}
+
+func decodeOutputs(outputs []byte) (TxOutputs, error) {
+	var outs TxOutputs
+	dec := newDecoder(outputs)
+	dec.version(serializationVersion)
+	for n := dec.length(); n > 0 && dec.err == nil; n-- {
+		idx := dec.uvarint()
+		outs.Add(int(idx), dec.output())
+	}
+	return outs, dec.finish()
+}
+
+//Deserialize gob encoded outputs written by older versions
+func legacyDeserializeOutputs(outputs []byte) (TxOutputs, error) {
 	var outs TxOutputs
 	decode := gob.NewDecoder(bytes.NewReader(outputs))
 	err := decode.Decode(&outs)
-	Handle(err)
-	return outs
+	return outs, err
 }
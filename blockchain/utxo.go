@@ -3,6 +3,7 @@ package blockchain
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"log"
 
 	"github.com/dgraph-io/badger"
@@ -11,8 +12,48 @@ import (
 var (
 	utxoPrefix   = []byte("utxo-")
 	prefixLength = len(utxoPrefix)
+	//outputs spent by a block, so disconnecting it doesn't need their transactions
+	undoPrefix = []byte("undo-")
+	//hash of the last block applied to the UTXO set, the same as lh
+	//unless an older version stopped between writing a block and the set
+	utxoTipKey = []byte("utxotip")
 )
 
+//output spent by an input
+type spentOutput struct {
+	TxID  []byte
+	Index int
+	Out   TxOutput
+}
+
+func undoEntry(blockHash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), blockHash...)
+}
+
+func encodeUndo(spent []spentOutput) []byte {
+	enc := encoder{}
+	enc.uvarint(serializationVersion)
+	enc.uvarint(uint64(len(spent)))
+	for _, s := range spent {
+		enc.bytes(s.TxID)
+		enc.uvarint(uint64(s.Index))
+		enc.output(s.Out)
+	}
+	return enc.buf.Bytes()
+}
+
+func decodeUndo(data []byte) ([]spentOutput, error) {
+	var spent []spentOutput
+	dec := newDecoder(data)
+	dec.version(serializationVersion)
+	for n := dec.length(); n > 0 && dec.err == nil; n-- {
+		txID := dec.bytes()
+		index := int(dec.uvarint())
+		spent = append(spent, spentOutput{txID, index, dec.output()})
+	}
+	return spent, dec.finish()
+}
+
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
@@ -34,73 +75,177 @@ func (utxo UTXOSet) CountTransacs() int {
 	return count
 }
 
-func (u UTXOSet) Reindex() {
+//rebuild the UTXO set from the blocks. The utxotip marker is removed
+//first and only set again once the set is complete, so an interrupted
+//rebuild is started over by repairUTXO
+func (u UTXOSet) Reindex() error {
 	db := u.Blockchain.Database
+	u.Blockchain.writer.Lock()
+	defer u.Blockchain.writer.Unlock()
+
+	//collected before deleting, it fails on pruned chains
+	UTXO, err := u.Blockchain.FindUnspentTransactions()
+	if err != nil {
+		return err
+	}
 
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(utxoTipKey)
+	})
+	if err != nil {
+		return err
+	}
 	u.DeleteByPrefix(utxoPrefix)
 
-	UTXO := u.Blockchain.FindUnspentTransactions()
+	var entries []dbEntry
+	stats := newUTXODelta()
+	for txId, outs := range UTXO {
+		key, err := hex.DecodeString(txId)
+		if err != nil {
+			return err
+		}
+		stats.addOutputs(key, outs)
+		entries = append(entries, dbEntry{append(append([]byte{}, utxoPrefix...), key...), outs.SerializeOutputs()})
+	}
+	set := newUTXOStats()
+	set.apply(stats)
+	entries = append(entries, dbEntry{utxoStatsKey, set.encode()})
+	if err := writeEntries(db, entries); err != nil {
+		return err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for txId, outs := range UTXO {
-			key, err := hex.DecodeString(txId)
-			Handle(err)
-			key = append(utxoPrefix, key...)
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(utxoTipKey, u.Blockchain.LastHash())
+	})
+}
 
-			err = txn.Set(key, outs.SerializeOutputs())
-			Handle(err)
+//catch the UTXO set up with the tip when an older version stopped between
+//writing a block and updating the set, rebuilding it when it isn't at a
+//block of the chain or a rebuild was interrupted
+func (chain *Blockchain) repairUTXO() error {
+	var utxoTip []byte
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoTipKey)
+		if err != nil {
+			return err
 		}
-		return nil
+		utxoTip, err = item.ValueCopy(nil)
+		return err
 	})
-	Handle(err)
+	if err == badger.ErrKeyNotFound {
+		fmt.Println("A rebuild of the UTXO set was interrupted, starting it over")
+		return UTXOSet{chain}.Reindex()
+	}
+	if err != nil || bytes.Equal(utxoTip, chain.LastHash()) {
+		return err
+	}
+
+	var behind []*Block
+	for hash := chain.LastHash(); !bytes.Equal(hash, utxoTip); {
+		if len(hash) == 0 {
+			if chain.HasPrunedBlocks() {
+				return fmt.Errorf("UTXO set is at block %x which isn't on the chain", utxoTip)
+			}
+			fmt.Println("The UTXO set isn't at a block of the chain, rebuilding it")
+			return UTXOSet{chain}.Reindex()
+		}
+		block, err := chain.getBlock(hash)
+		if err != nil {
+			return err
+		}
+		if block.Pruned() {
+			return fmt.Errorf("catching the UTXO set up: %w: %x", ErrBlockPruned, hash)
+		}
+		behind = append(behind, block)
+		hash = block.PrevHash
+	}
+
+	UTXO := UTXOSet{chain}
+	for i := len(behind) - 1; i >= 0; i-- {
+		UTXO.Update(behind[i])
+	}
+	fmt.Printf("Caught the UTXO set up with %d blocks\n", len(behind))
+	return nil
 }
 
+//apply block to the UTXO set on its own, blocks added to the chain update
+//it in the transaction that stores them
 func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
+	u.Blockchain.writer.Lock()
+	defer u.Blockchain.writer.Unlock()
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinBase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-					v, err := item.Value()
-					Handle(err)
-
-					outs := DeserializeOutputs(v)
-
-					for idx, out := range outs.Outputs {
-						if idx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+	err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return updateUTXO(txn, block)
+	})
+	Handle(err)
+}
+
+//spend the inputs of block and add its outputs, keeping the undo data,
+//the stats and the block the set is at
+func updateUTXO(txn *badger.Txn, block *Block) error {
+	var spent []spentOutput
+	delta := newUTXODelta()
+	for _, tx := range block.Transactions {
+		if tx.IsCoinBase() == false {
+			for _, in := range tx.Inputs {
+				updatedOuts := TxOutputs{}
+				inID := append(utxoPrefix, in.ID...)
+				item, err := txn.Get(inID)
+				if err != nil {
+					return fmt.Errorf("spending %s: %v", outpointKey(in.ID, in.Out), err)
+				}
+				v, err := item.Value()
+				if err != nil {
+					return err
+				}
 
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
+				outs := DeserializeOutputs(v)
+
+				for i, out := range outs.Outputs {
+					if idx := outs.Index(i); idx != in.Out {
+						updatedOuts.Add(idx, out)
 					} else {
-						if err := txn.Set(inID, updatedOuts.SerializeOutputs()); err != nil {
-							log.Panic(err)
-						}
+						spent = append(spent, spentOutput{in.ID, idx, out})
+						delta.remove(in.ID, idx, out)
 					}
 				}
+
+				if len(updatedOuts.Outputs) == 0 {
+					err = txn.Delete(inID)
+				} else {
+					err = txn.Set(inID, updatedOuts.SerializeOutputs())
+				}
+				if err != nil {
+					return err
+				}
 			}
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+		}
+		newOutputs := TxOutputs{}
+		for outIdx, out := range tx.Outputs {
+			if !out.IsData() {
+				newOutputs.Add(outIdx, out)
 			}
+		}
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
+		delta.addOutputs(tx.ID, newOutputs)
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.SerializeOutputs()); err != nil {
-				log.Panic(err)
-			}
+		txID := append(utxoPrefix, tx.ID...)
+		if err := txn.Set(txID, newOutputs.SerializeOutputs()); err != nil {
+			return err
 		}
+	}
+	if err := updateUTXOStats(txn, delta); err != nil {
+		return err
+	}
+	if err := txn.Set(utxoTipKey, block.Hash); err != nil {
+		return err
+	}
+	if len(spent) == 0 {
 		return nil
-	})
-	Handle(err)
+	}
+	return txn.Set(undoEntry(block.Hash), encodeUndo(spent))
 }
 
 func (utxo *UTXOSet) DeleteByPrefix(prefix []byte) {
@@ -148,6 +293,119 @@ func (utxo *UTXOSet) DeleteByPrefix(prefix []byte) {
 	})
 }
 
+//remove the outputs of block and bring back the ones it spent, spent
+//is keyed by outpointKey
+func revertUTXO(txn *badger.Txn, block *Block, spent map[string]TxOutput) error {
+	delta := newUTXODelta()
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		txID := append(utxoPrefix, tx.ID...)
+		item, err := txn.Get(txID)
+		if err == nil {
+			v, err := item.Value()
+			if err != nil {
+				return err
+			}
+			outs := DeserializeOutputs(v)
+			for j, out := range outs.Outputs {
+				delta.remove(tx.ID, outs.Index(j), out)
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err := txn.Delete(txID); err != nil {
+			return err
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			inID := append(utxoPrefix, in.ID...)
+			outs := TxOutputs{}
+			item, err := txn.Get(inID)
+			if err == nil {
+				v, err := item.Value()
+				if err != nil {
+					return err
+				}
+				outs = DeserializeOutputs(v)
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			out := spent[outpointKey(in.ID, in.Out)]
+			outs.Add(in.Out, out)
+			delta.add(in.ID, in.Out, out)
+			if err := txn.Set(inID, outs.SerializeOutputs()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := updateUTXOStats(txn, delta); err != nil {
+		return err
+	}
+	if err := txn.Set(utxoTipKey, block.PrevHash); err != nil {
+		return err
+	}
+	return txn.Delete(undoEntry(block.Hash))
+}
+
+func outpointKey(txID []byte, index int) string {
+	return fmt.Sprintf("%x:%d", txID, index)
+}
+
+//add the outputs in the undo data of block to spent, nothing when it has none
+func readUndo(txn *badger.Txn, block *Block, spent map[string]TxOutput) error {
+	item, err := txn.Get(undoEntry(block.Hash))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	value, err := item.Value()
+	if err != nil {
+		return err
+	}
+	undo, err := decodeUndo(value)
+	for _, s := range undo {
+		spent[outpointKey(s.TxID, s.Index)] = s.Out
+	}
+	return err
+}
+
+//outputs spent by block keyed by outpointKey
+func (u *UTXOSet) spentOutputs(block *Block) (map[string]TxOutput, error) {
+	spent := make(map[string]TxOutput)
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		return readUndo(txn, block, spent)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if _, ok := spent[outpointKey(in.ID, in.Out)]; ok {
+				continue
+			}
+			prevTx, err := u.Blockchain.FindTransaction(in.ID)
+			if err != nil {
+				return nil, err
+			}
+			if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+				return nil, fmt.Errorf("transaction %x has no output %d", in.ID, in.Out)
+			}
+			spent[outpointKey(in.ID, in.Out)] = prevTx.Outputs[in.Out]
+		}
+	}
+	return spent, nil
+}
+
 //Finding all unspent transaction outputs
 func (u UTXOSet) FindUTXOut(publicKeyHash []byte) []TxOutput {
 	var UTXout []TxOutput
@@ -175,12 +433,10 @@ func (u UTXOSet) FindUTXOut(publicKeyHash []byte) []TxOutput {
 	return UTXout
 }
 
-//for transactions that are not coin based
-//find how many tokens available
-func (u UTXOSet) FindSpendableOutput(publicKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOutput := make(map[string][]int)
+//unspent outputs locked with publicKeyHash
+func (u UTXOSet) FindSpendableOutputs(publicKeyHash []byte) []UTXO {
+	var utxos []UTXO
 	db := u.Blockchain.Database
-	accumulated := 0
 
 	err := db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
@@ -189,23 +445,48 @@ func (u UTXOSet) FindSpendableOutput(publicKeyHash []byte, amount int) (int, map
 
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
 			item := it.Item()
-			key := item.Key()
+			txID := bytes.TrimPrefix(item.KeyCopy(nil), utxoPrefix)
 			v, err := item.Value()
 			Handle(err)
-			key = bytes.TrimPrefix(key, utxoPrefix)
-			txID := hex.EncodeToString(key)
 			outs := DeserializeOutputs(v)
 
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(publicKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutput[txID] = append(unspentOutput[txID], outIdx)
+			for i, out := range outs.Outputs {
+				if out.IsLockedWithKey(publicKeyHash) {
+					utxos = append(utxos, UTXO{txID, outs.Index(i), out.Value})
 				}
 			}
 		}
 		return nil
 	})
 	Handle(err)
+	return utxos
+}
 
-	return accumulated, unspentOutput
+//unspent output index of transaction txID
+func (u UTXOSet) FindOutput(txID []byte, index int) (TxOutput, bool) {
+	var output TxOutput
+	found := false
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(utxoPrefix, txID...))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		v, err := item.Value()
+		if err != nil {
+			return err
+		}
+		outs := DeserializeOutputs(v)
+		for i, out := range outs.Outputs {
+			if outs.Index(i) == index {
+				output, found = out, true
+			}
+		}
+		return nil
+	})
+	Handle(err)
+	return output, found
 }
@@ -0,0 +1,218 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+//Rolling commitment to the UTXO set, a MuHash over its unspent outputs.
+//Every output is hashed to a number modulo a 3072 bit prime and the set
+//hash is their product, so Update multiplies in created outputs and divides
+//out spent ones without reading the rest of the set. Nodes holding the same
+//outputs get the same hash whatever order they were added in.
+var utxoStatsKey = []byte("utxostats")
+
+const muHashBytes = 3072 / 8
+
+//2^3072 - 1103717, the largest 3072 bit safe prime
+var muHashPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1103717))
+
+//summary of the UTXO set kept up to date with it
+type UTXOStats struct {
+	Count int //unspent outputs
+	Total int //sum of their values
+	state *big.Int
+}
+
+func newUTXOStats() *UTXOStats {
+	return &UTXOStats{state: big.NewInt(1)}
+}
+
+//digest of the set hash
+func (stats *UTXOStats) Hash() []byte {
+	raw := stats.state.Bytes()
+	buf := make([]byte, muHashBytes-len(raw), muHashBytes)
+	sum := sha256.Sum256(append(buf, raw...))
+	return sum[:]
+}
+
+func (stats *UTXOStats) apply(delta *utxoDelta) {
+	stats.Count += delta.count
+	stats.Total += delta.total
+	stats.state.Mul(stats.state, delta.added)
+	stats.state.Mod(stats.state, muHashPrime)
+	if delta.removed.Cmp(big.NewInt(1)) != 0 {
+		stats.state.Mul(stats.state, new(big.Int).ModInverse(delta.removed, muHashPrime))
+		stats.state.Mod(stats.state, muHashPrime)
+	}
+}
+
+func (stats *UTXOStats) encode() []byte {
+	raw := stats.state.Bytes()
+	enc := encoder{}
+	enc.uvarint(serializationVersion)
+	enc.uvarint(uint64(stats.Count))
+	enc.varint(int64(stats.Total))
+	enc.bytes(append(make([]byte, muHashBytes-len(raw)), raw...))
+	return enc.buf.Bytes()
+}
+
+func decodeUTXOStats(data []byte) (*UTXOStats, error) {
+	stats := &UTXOStats{}
+	dec := newDecoder(data)
+	dec.version(serializationVersion)
+	stats.Count = int(dec.uvarint())
+	stats.Total = int(dec.varint())
+	stats.state = new(big.Int).SetBytes(dec.bytes())
+	if err := dec.finish(); err != nil {
+		return nil, err
+	}
+	if stats.state.Sign() == 0 || stats.state.Cmp(muHashPrime) >= 0 {
+		return nil, fmt.Errorf("UTXO set hash out of range")
+	}
+	return stats, nil
+}
+
+//outputs created and spent by a change to the UTXO set
+type utxoDelta struct {
+	count, total   int
+	added, removed *big.Int
+}
+
+func newUTXODelta() *utxoDelta {
+	return &utxoDelta{added: big.NewInt(1), removed: big.NewInt(1)}
+}
+
+func (delta *utxoDelta) add(txID []byte, index int, out TxOutput) {
+	delta.count++
+	delta.total += out.Value
+	delta.added.Mul(delta.added, muHashElement(txID, index, out))
+	delta.added.Mod(delta.added, muHashPrime)
+}
+
+func (delta *utxoDelta) remove(txID []byte, index int, out TxOutput) {
+	delta.count--
+	delta.total -= out.Value
+	delta.removed.Mul(delta.removed, muHashElement(txID, index, out))
+	delta.removed.Mod(delta.removed, muHashPrime)
+}
+
+func (delta *utxoDelta) addOutputs(txID []byte, outs TxOutputs) {
+	for i, out := range outs.Outputs {
+		delta.add(txID, outs.Index(i), out)
+	}
+}
+
+//the output hashed to a number below the prime, sha256 of the encoded
+//outpoint stretched to 3072 bits in counter mode
+func muHashElement(txID []byte, index int, out TxOutput) *big.Int {
+	enc := encoder{}
+	enc.bytes(txID)
+	enc.uvarint(uint64(index))
+	enc.output(out)
+	seed := sha256.Sum256(enc.buf.Bytes())
+
+	buf := make([]byte, 0, muHashBytes)
+	for i := 0; len(buf) < muHashBytes; i++ {
+		block := sha256.Sum256(append(seed[:], byte(i)))
+		buf = append(buf, block[:]...)
+	}
+	element := new(big.Int).SetBytes(buf)
+	return element.Mod(element, muHashPrime)
+}
+
+//fold delta into the stored stats, nothing to do before the database is
+//migrated to keep them
+func updateUTXOStats(txn *badger.Txn, delta *utxoDelta) error {
+	item, err := txn.Get(utxoStatsKey)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	value, err := item.Value()
+	if err != nil {
+		return err
+	}
+	stats, err := decodeUTXOStats(value)
+	if err != nil {
+		return err
+	}
+	stats.apply(delta)
+	return txn.Set(utxoStatsKey, stats.encode())
+}
+
+//stats of the utxo- entries as stored
+func scanUTXOStats(txn *badger.Txn) (*UTXOStats, error) {
+	delta := newUTXODelta()
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+		value, err := it.Item().Value()
+		if err != nil {
+			return nil, err
+		}
+		outs, err := decodeOutputs(value)
+		if err != nil {
+			return nil, fmt.Errorf("UTXO entry %x: %v", it.Item().Key()[prefixLength:], err)
+		}
+		delta.addOutputs(it.Item().KeyCopy(nil)[prefixLength:], outs)
+	}
+	stats := newUTXOStats()
+	stats.apply(delta)
+	return stats, nil
+}
+
+//count, total and hash of the UTXO set
+func (u UTXOSet) Stats() (*UTXOStats, error) {
+	var stats *UTXOStats
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoStatsKey)
+		if err != nil {
+			return err
+		}
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		stats, err = decodeUTXOStats(value)
+		return err
+	})
+	return stats, err
+}
+
+//compare the stored stats with the entries they summarize
+func (u UTXOSet) verifyStats() error {
+	return u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoStatsKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		stored, err := decodeUTXOStats(value)
+		if err != nil {
+			return err
+		}
+		actual, err := scanUTXOStats(txn)
+		if err != nil {
+			return err
+		}
+		if stored.Count != actual.Count || stored.Total != actual.Total || stored.state.Cmp(actual.state) != 0 {
+			return fmt.Errorf("UTXO set hash %s doesn't match its entries, they hash to %s",
+				hex.EncodeToString(stored.Hash()), hex.EncodeToString(actual.Hash()))
+		}
+		return nil
+	})
+}
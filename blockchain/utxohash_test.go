@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/shraddha0602/blockchain-implementation/wallet"
+)
+
+type testOutpoint struct {
+	txID  []byte
+	index int
+	out   TxOutput
+}
+
+func testOutpoints(n int) []testOutpoint {
+	var outpoints []testOutpoint
+	for i := 0; i < n; i++ {
+		txID := sha256.Sum256([]byte{byte(i)})
+		pubKeyHash := make([]byte, wallet.PubKeyHashLen)
+		pubKeyHash[0] = byte(i)
+		outpoints = append(outpoints, testOutpoint{txID[:], i % 3, TxOutput{Value: 10 + i, PubKeyHash: pubKeyHash}})
+	}
+	return outpoints
+}
+
+func TestUTXOStatsAddRemove(t *testing.T) {
+	outpoints := testOutpoints(8)
+	stats := newUTXOStats()
+	empty := stats.Hash()
+
+	added := newUTXODelta()
+	for _, o := range outpoints {
+		added.add(o.txID, o.index, o.out)
+	}
+	stats.apply(added)
+	if bytes.Equal(stats.Hash(), empty) {
+		t.Fatal("hash didn't change adding outputs")
+	}
+
+	//spent two at a time in reverse order
+	for i := len(outpoints) - 1; i >= 0; i -= 2 {
+		removed := newUTXODelta()
+		removed.remove(outpoints[i].txID, outpoints[i].index, outpoints[i].out)
+		removed.remove(outpoints[i-1].txID, outpoints[i-1].index, outpoints[i-1].out)
+		stats.apply(removed)
+	}
+	if !bytes.Equal(stats.Hash(), empty) || stats.Count != 0 || stats.Total != 0 {
+		t.Errorf("emptied set has hash %x of %d outputs worth %d, want %x", stats.Hash(), stats.Count, stats.Total, empty)
+	}
+}
+
+func TestUTXOStatsOrder(t *testing.T) {
+	outpoints := testOutpoints(6)
+
+	inOrder := newUTXOStats()
+	delta := newUTXODelta()
+	for _, o := range outpoints {
+		delta.add(o.txID, o.index, o.out)
+	}
+	inOrder.apply(delta)
+
+	//reversed, one output per delta
+	reversed := newUTXOStats()
+	for i := len(outpoints) - 1; i >= 0; i-- {
+		delta := newUTXODelta()
+		delta.add(outpoints[i].txID, outpoints[i].index, outpoints[i].out)
+		reversed.apply(delta)
+	}
+	if !bytes.Equal(inOrder.Hash(), reversed.Hash()) {
+		t.Errorf("hash %x in order, %x reversed", inOrder.Hash(), reversed.Hash())
+	}
+
+	//the same outputs with one value changed hash differently
+	changed := newUTXOStats()
+	delta = newUTXODelta()
+	for i, o := range outpoints {
+		if i == 0 {
+			o.out.Value++
+		}
+		delta.add(o.txID, o.index, o.out)
+	}
+	changed.apply(delta)
+	if bytes.Equal(inOrder.Hash(), changed.Hash()) {
+		t.Error("changing an output value kept the hash")
+	}
+
+	decoded, err := decodeUTXOStats(inOrder.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Hash(), inOrder.Hash()) || decoded.Count != inOrder.Count || decoded.Total != inOrder.Total {
+		t.Error("stats changed going through their encoding")
+	}
+}
@@ -0,0 +1,204 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/shraddha0602/blockchain-implementation/wallet"
+)
+
+//only pruned blocks in the database keep their Merkle root, blocks
+//received must carry their transactions
+var errStoredMerkleRoot = errors.New("block carries a stored Merkle root")
+
+//check that block can extend the tip: its seal, the transaction ids, that
+//only the first transaction is a coinbase, and that every input spends an
+//unspent output with a valid signature without creating value
+func (chain *Blockchain) CheckBlock(block *Block) error {
+	if lastHash := chain.LastHash(); !bytes.Equal(block.PrevHash, lastHash) {
+		return fmt.Errorf("block %x doesn't extend the tip %x", block.Hash, lastHash)
+	}
+	if block.MerkleRoot != nil {
+		return fmt.Errorf("block %x: %v", block.Hash, errStoredMerkleRoot)
+	}
+	if err := chain.Engine.VerifySeal(chain, block); err != nil {
+		return fmt.Errorf("block %x: %v", block.Hash, err)
+	}
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("block %x has no transactions", block.Hash)
+	}
+
+	UTXO := UTXOSet{chain}
+	//outputs created and spent by earlier transactions of the block
+	created := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	fees := 0
+
+	for pos, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, block.txID(tx)) {
+			return fmt.Errorf("transaction %x: id doesn't match its contents", tx.ID)
+		}
+		if tx.IsCoinBase() {
+			if pos != 0 {
+				return fmt.Errorf("transaction %x: coinbase must be the first transaction", tx.ID)
+			}
+			created[hex.EncodeToString(tx.ID)] = *tx
+			continue
+		}
+		fee, err := chain.checkInputs(UTXO, block, tx, created, spent)
+		if err != nil {
+			return fmt.Errorf("transaction %x: %v", tx.ID, err)
+		}
+		var ok bool
+		if fees, ok = addValues(fees, fee); !ok {
+			return fmt.Errorf("block %x: fees overflow", block.Hash)
+		}
+		created[hex.EncodeToString(tx.ID)] = *tx
+	}
+	if coinbase := block.Transactions[0]; coinbase.IsCoinBase() {
+		if err := checkCoinbase(coinbase, fees); err != nil {
+			return fmt.Errorf("transaction %x: %v", coinbase.ID, err)
+		}
+	}
+	return nil
+}
+
+//the coinbase can't pay out more than the subsidy and the fees of its block
+func checkCoinbase(tx *Transaction, fees int) error {
+	limit, ok := addValues(subsidy, fees)
+	if !ok {
+		return errors.New("fees overflow")
+	}
+	out, err := outputsValue(tx)
+	if err != nil {
+		return err
+	}
+	if out > limit {
+		return fmt.Errorf("coinbase pays %d, more than the subsidy and fees of %d", out, limit)
+	}
+	return nil
+}
+
+//sum of the output values of tx, which can't be negative, each spendable
+//output must be locked to a public key hash and data outputs carry nothing
+//but their data
+func outputsValue(tx *Transaction) (int, error) {
+	total := 0
+	for _, output := range tx.Outputs {
+		if output.Value < 0 {
+			return 0, errors.New("negative output value")
+		}
+		if output.IsData() {
+			if len(output.Data) > MaxDataSize {
+				return 0, errors.New("data output exceeds maximum size")
+			}
+			if output.Value != 0 || len(output.PubKeyHash) > 0 {
+				return 0, errors.New("data output with a value or a public key hash")
+			}
+		} else if len(output.PubKeyHash) != wallet.PubKeyHashLen {
+			//the address index keys outputs by their hash, a longer one
+			//would share a prefix with another address
+			return 0, fmt.Errorf("output locked to a %d byte hash", len(output.PubKeyHash))
+		}
+		var ok bool
+		if total, ok = addValues(total, output.Value); !ok {
+			return 0, errors.New("output values overflow")
+		}
+	}
+	return total, nil
+}
+
+//where checkInputs finds the outputs spent by earlier blocks, the UTXO set
+//or an in-memory view of it
+type outputSource interface {
+	FindOutput(txID []byte, index int) (TxOutput, bool)
+}
+
+//outputs keyed by outpointKey, e.g. the ones a block spent
+type outputMap map[string]TxOutput
+
+func (outs outputMap) FindOutput(txID []byte, index int) (TxOutput, bool) {
+	out, ok := outs[outpointKey(txID, index)]
+	return out, ok
+}
+
+//check the inputs of tx spend unspent outputs it is allowed to, returning
+//the fee it leaves
+func (chain *Blockchain) checkInputs(UTXO outputSource, block *Block, tx *Transaction, created map[string]Transaction, spent map[string]bool) (int, error) {
+	prevOuts := make(map[string]TxOutput)
+	in := 0
+	for _, input := range tx.Inputs {
+		outpoint := outpointKey(input.ID, input.Out)
+		if spent[outpoint] {
+			return 0, fmt.Errorf("output %s is spent twice", outpoint)
+		}
+		spent[outpoint] = true
+
+		var out TxOutput
+		if prevTx, ok := created[hex.EncodeToString(input.ID)]; ok {
+			if input.Out < 0 || input.Out >= len(prevTx.Outputs) || prevTx.Outputs[input.Out].IsData() {
+				return 0, fmt.Errorf("output %s doesn't exist", outpoint)
+			}
+			out = prevTx.Outputs[input.Out]
+		} else {
+			var found bool
+			if out, found = UTXO.FindOutput(input.ID, input.Out); !found {
+				return 0, fmt.Errorf("output %s is missing or already spent", outpoint)
+			}
+		}
+		var ok bool
+		if in, ok = addValues(in, out.Value); !ok {
+			return 0, errors.New("input values overflow")
+		}
+		prevOuts[outpointKey(input.ID, input.Out)] = out
+	}
+
+	out, err := outputsValue(tx)
+	if err != nil {
+		return 0, err
+	}
+	if out > in {
+		return 0, fmt.Errorf("outputs of %d exceed inputs of %d", out, in)
+	}
+	if !block.verifySignatures(tx, prevOuts) {
+		return 0, errors.New("invalid signature")
+	}
+	return in - out, nil
+}
+
+//hash the id of tx is set to, signatures are added after the id so they
+//are left out
+func (tx *Transaction) unsignedHash() []byte {
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		txCopy.Inputs[i] = TxInput{in.ID, in.Out, nil, in.PubKey}
+	}
+	return txCopy.Hash()
+}
+
+//id of a transaction of a legacy block, the gob hash of it unsigned
+func (tx *Transaction) legacyUnsignedHash() []byte {
+	txCopy := *tx
+	txCopy.ID = nil
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		txCopy.Inputs[i] = TxInput{in.ID, in.Out, nil, in.PubKey}
+	}
+	hash := sha256.Sum256(txCopy.legacySerialize())
+	return hash[:]
+}
+
+//validate block and make it the new tip, updating the UTXO set
+func (chain *Blockchain) ConnectBlock(block *Block) error {
+	chain.writer.Lock()
+	defer chain.writer.Unlock()
+
+	if err := chain.CheckBlock(block); err != nil {
+		return err
+	}
+	return chain.storeBlock(block)
+}
@@ -0,0 +1,180 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+//How thoroughly VerifyChain checks, each level includes the ones below
+const (
+	VerifyHeaders      = 0 //seals, which cover the Merkle roots, and prev-hash links
+	VerifyTransactions = 1 //transaction ids and coinbase placement
+	VerifySignatures   = 2 //every input spends an existing output once with a valid signature, without creating value
+	VerifyUTXO         = 3 //the stored UTXO set matches one rebuilt from the blocks
+)
+
+//check the depth most recent blocks (all when depth <= 0) from the tip,
+//returning the number of blocks checked and the first inconsistency found
+func (chain *Blockchain) VerifyChain(depth, level int) (int, error) {
+	checked := 0
+	//outputs spent by the blocks checked so far, an output spent again
+	//further down is a double spend
+	spent := make(map[string]bool)
+	itr := chain.Iterator()
+	defer itr.Close()
+	for depth <= 0 || checked < depth {
+		hash := itr.CurrentHash
+		block, err := itr.next()
+		if err != nil {
+			return checked, fmt.Errorf("block %x: %v", hash, err)
+		}
+		if err := chain.verifyBlock(hash, block, level, spent); err != nil {
+			return checked, err
+		}
+		checked++
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	if level >= VerifyUTXO {
+		if err := chain.verifyUTXO(); err != nil {
+			return checked, err
+		}
+	}
+	return checked, nil
+}
+
+func (chain *Blockchain) verifyBlock(hash []byte, block *Block, level int, spent map[string]bool) error {
+	if !bytes.Equal(block.Hash, hash) {
+		return fmt.Errorf("block stored under %x has hash %x", hash, block.Hash)
+	}
+	if err := chain.Engine.VerifySeal(chain, block); err != nil {
+		return fmt.Errorf("block %x: %v", hash, err)
+	}
+	//only the seal of a pruned block can be checked
+	if level < VerifyTransactions || block.Pruned() {
+		return nil
+	}
+
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("block %x has no transactions", hash)
+	}
+	var prevOuts map[string]TxOutput
+	if level >= VerifySignatures {
+		var err error
+		prevOuts, err = (&UTXOSet{chain}).spentOutputs(block)
+		//blocks without undo data spending outputs of pruned blocks
+		//can't have their inputs checked
+		if errors.Is(err, ErrBlockPruned) {
+			level = VerifyTransactions
+		} else if err != nil {
+			return fmt.Errorf("block %x: %v", hash, err)
+		}
+	}
+	//the inputs are checked against the outputs the block spent, which
+	//is the UTXO set as it was before the block
+	created := make(map[string]Transaction)
+	fees := 0
+	for pos, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, block.txID(tx)) {
+			return fmt.Errorf("block %x: transaction %x: id doesn't match its contents", hash, tx.ID)
+		}
+		if tx.IsCoinBase() && pos != 0 {
+			return fmt.Errorf("block %x: transaction %x: coinbase must be the first transaction", hash, tx.ID)
+		}
+		if level >= VerifySignatures && !tx.IsCoinBase() {
+			fee, err := chain.checkInputs(outputMap(prevOuts), block, tx, created, spent)
+			if err != nil {
+				return fmt.Errorf("block %x: transaction %x: %v", hash, tx.ID, err)
+			}
+			var ok bool
+			if fees, ok = addValues(fees, fee); !ok {
+				return fmt.Errorf("block %x: fees overflow", hash)
+			}
+		}
+		created[hex.EncodeToString(tx.ID)] = *tx
+	}
+	if coinbase := block.Transactions[0]; level >= VerifySignatures && coinbase.IsCoinBase() {
+		if err := checkCoinbase(coinbase, fees); err != nil {
+			return fmt.Errorf("block %x: transaction %x: %v", hash, coinbase.ID, err)
+		}
+	}
+	return nil
+}
+
+//check the stored UTXO set hash and compare the utxo- entries with the
+//unspent outputs of the blocks
+func (chain *Blockchain) verifyUTXO() error {
+	if err := (UTXOSet{chain}).verifyStats(); err != nil {
+		return err
+	}
+	if chain.HasPrunedBlocks() {
+		return fmt.Errorf("can't rebuild the UTXO set: %w", ErrBlockPruned)
+	}
+	unspent, err := chain.FindUnspentTransactions()
+	if err != nil {
+		return err
+	}
+	expected := outpoints(unspent)
+
+	stored := make(map[string]TxOutputs)
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			value, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			stored[hex.EncodeToString(it.Item().Key()[prefixLength:])] = DeserializeOutputs(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	actual := outpoints(stored)
+
+	var keys []string
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		want, inBlocks := expected[key]
+		got, inSet := actual[key]
+		switch {
+		case !inSet:
+			return fmt.Errorf("UTXO set is missing unspent output %s", key)
+		case !inBlocks:
+			return fmt.Errorf("UTXO set holds %s which is spent or doesn't exist", key)
+		case want.Value != got.Value || !bytes.Equal(want.PubKeyHash, got.PubKeyHash):
+			return fmt.Errorf("UTXO set entry %s doesn't match its transaction", key)
+		}
+	}
+	return nil
+}
+
+//outputs keyed by txid:index
+func outpoints(UTXO map[string]TxOutputs) map[string]TxOutput {
+	outs := make(map[string]TxOutput)
+	for txID, txOuts := range UTXO {
+		for i, out := range txOuts.Outputs {
+			outs[fmt.Sprintf("%s:%d", txID, txOuts.Index(i))] = out
+		}
+	}
+	return outs
+}
@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/dgraph-io/badger"
+	"github.com/shraddha0602/blockchain-implementation/wallet"
+)
+
+//hashes of the main chain, index is the height and genesis is 0
+func (chain *Blockchain) BlockHashes() [][]byte {
+	_, hashes := chain.hashesAfter(nil)
+	return hashes
+}
+
+//Walk back from the tip until a block of known, which holds the hashes of
+//a chain by height. Returns the height after that block, where known and
+//the main chain fork, and the main chain hashes from there in order.
+func (chain *Blockchain) hashesAfter(known [][]byte) (int, [][]byte) {
+	heights := make(map[string]int, len(known))
+	for height, hash := range known {
+		heights[string(hash)] = height
+	}
+	var hashes [][]byte
+	fork := 0
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		hash, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		for len(hash) > 0 {
+			//blocks link to their parent, so everything below is known too
+			if height, ok := heights[string(hash)]; ok {
+				fork = height + 1
+				break
+			}
+			hashes = append(hashes, hash)
+
+			item, err := txn.Get(hash)
+			if err != nil {
+				return err
+			}
+			encodedBlock, err := item.Value()
+			if err != nil {
+				return err
+			}
+			hash = Deserialize(encodedBlock).PrevHash
+		}
+		return nil
+	})
+	Handle(err)
+
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	return fork, hashes
+}
+
+//Bring the wallet index to the tip: blocks it connected that left the
+//main chain are disconnected, then the missing blocks are connected.
+//Only the blocks above the last one the wallet shares with the main chain
+//are read. Returns the number of blocks disconnected and connected;
+//syncing stops with ErrBlockPruned at a block whose transactions are gone.
+func (chain *Blockchain) SyncWallet(ws *wallet.Wallets) (int, int, error) {
+	synced := ws.SyncedBlocks()
+	fork, hashes := chain.hashesAfter(synced)
+
+	disconnected := len(synced) - fork
+	ws.Rollback(fork)
+
+	tracked := ws.PubKeyHashes()
+	for i, hash := range hashes {
+		block, err := chain.GetBlock(hash)
+		if errors.Is(err, ErrBlockPruned) {
+			return disconnected, i, err
+		}
+		Handle(err)
+		ws.ConnectBlock(walletUpdate(ws, tracked, block))
+	}
+	return disconnected, len(hashes), nil
+}
+
+//changes block makes to the outputs and history of the tracked public key
+//hashes (hex pkh -> address)
+func walletUpdate(ws *wallet.Wallets, tracked map[string]string, block *Block) wallet.BlockUpdate {
+	update := wallet.BlockUpdate{Hash: block.Hash, Records: make(map[string][]wallet.TxRecord)}
+	//outputs created earlier in this block
+	created := make(map[string]wallet.OwnedOutput)
+
+	for _, tx := range block.Transactions {
+		records := make(map[string]*wallet.TxRecord)
+		record := func(address string) *wallet.TxRecord {
+			if records[address] == nil {
+				records[address] = &wallet.TxRecord{TxID: tx.ID}
+			}
+			return records[address]
+		}
+
+		//inputs spending wallet outputs
+		spent, inValue, payer := false, 0, ""
+		allOwned := !tx.IsCoinBase()
+		if !tx.IsCoinBase() {
+			for _, in := range tx.Inputs {
+				key := wallet.OutpointKey(in.ID, in.Out)
+				out, ok := created[key]
+				if !ok {
+					out, ok = ws.Output(in.ID, in.Out)
+				}
+				if !ok {
+					allOwned = false
+					continue
+				}
+				spent = true
+				inValue += out.Value
+				if payer == "" {
+					payer = out.Address
+				}
+				record(out.Address).Sent += out.Value
+				update.Spent = append(update.Spent, key)
+			}
+		}
+
+		//outputs paying the wallet, change when the wallet spent
+		outValue := 0
+		for outIdx, out := range tx.Outputs {
+			if out.IsData() {
+				continue
+			}
+			outValue += out.Value
+			address, ok := tracked[hex.EncodeToString(out.PubKeyHash)]
+			if !ok {
+				continue
+			}
+			owned := wallet.OwnedOutput{TxID: tx.ID, Index: outIdx, Address: address, Value: out.Value}
+			created[wallet.OutpointKey(tx.ID, outIdx)] = owned
+			update.Created = append(update.Created, owned)
+			if spent {
+				record(address).Change += out.Value
+			} else {
+				record(address).Received += out.Value
+			}
+		}
+
+		//the fee is only known when the wallet funded every input
+		if spent && allOwned {
+			record(payer).Fee = inValue - outValue
+		}
+		for address, r := range records {
+			update.Records[address] = append(update.Records[address], *r)
+		}
+	}
+	return update
+}
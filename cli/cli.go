@@ -1,12 +1,20 @@
 package cli
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/shraddha0602/blockchain-implementation/blockchain"
 	"github.com/shraddha0602/blockchain-implementation/wallet"
@@ -18,12 +26,46 @@ type CommandLine struct{}
 func (cli *CommandLine) printUsage() {
 	fmt.Println("Usage : ")
 	fmt.Println(" getbalance -address <ADDRESS> - get the balance for given adress")
-	fmt.Println(" createblockchain - address <ADDRESS> - creates a blockchain")
+	fmt.Println(" createblockchain - address <ADDRESS> [-consensus pow|poa -signers <ADDRESS,...> -txindex -addrindex] - creates a blockchain")
 	fmt.Println(" print - prints the blockchain")
-	fmt.Println(" send -from <FROM> -to <TO> -amount <AMOUNT> -Send amount")
-	fmt.Println(" createwallet -Creates a New wallet")
-	fmt.Println(" listaddresses - Lists all addresses in Wallet file")
+	fmt.Println(" send -from <FROM> -to <TO> -amount <AMOUNT> [-strategy largest-first|smallest-first|branch-and-bound|random-improve -utxos <TXID:INDEX,...>] -Send amount")
+	fmt.Println(" sendmany -from <FROM> -payments <ADDRESS=AMOUNT,...|JSON> [-strategy <STRATEGY> -utxos <TXID:INDEX,...>] - Pays many addresses in one transaction")
+	fmt.Println(" createwallet [-bech32] -Creates a New wallet")
+	fmt.Println(" encryptwallet -passphrase <PASSPHRASE> - Encrypts the wallet file")
+	fmt.Println(" walletpassphrase -passphrase <PASSPHRASE> -timeout <SECONDS> - Unlocks the wallet for a while")
+	fmt.Println(" walletlock - Locks the wallet")
+	fmt.Println(" dumpprivkey -address <ADDRESS> - Prints the private key of an address")
+	fmt.Println(" importprivkey -key <KEY> [-rescan=false] - Adds a private key to the wallet")
+	fmt.Println(" dumpwallet -file <FILE> - Writes every key of the wallet to a JSON backup")
+	fmt.Println(" importwallet -file <FILE> [-rescan=false] - Adds the keys of a JSON backup to the wallet")
+	fmt.Println(" importaddress -address <ADDRESS|PUBKEY> [-rescan=false] - Watches an address without its private key")
+	fmt.Println(" rescanwallet [-from-height <HEIGHT>] - Rebuilds the wallet transactions from the blockchain")
+	fmt.Println(" listtransactions -address <ADDRESS> [-count <N> -skip <N>] - Lists the wallet transactions of an address")
+	fmt.Println(" signmessage -address <ADDRESS> -message <MESSAGE> - Signs a message with the key of an address")
+	fmt.Println(" verifymessage -address <ADDRESS> -signature <SIGNATURE> -message <MESSAGE> - Checks a signed message")
+	fmt.Println(" hdsetup [-mnemonic <WORDS>] - Gives the wallet a new HD seed or restores one from its mnemonic")
+	fmt.Println(" dumpmnemonic - Prints the mnemonic backing up the HD seed")
+	fmt.Println(" rescanhd - Finds the used addresses of the HD seed on the blockchain")
+	fmt.Println(" listaddresses [-bech32] - Lists all addresses in Wallet file")
 	fmt.Println(" reindexUTXO - Rebuilds the UTXO set")
+	fmt.Println(" gettxoutsetinfo - Prints the size, total amount and hash of the UTXO set")
+	fmt.Println(" migratedb [-dry-run] - Upgrades the database to the schema of this version, or lists the steps needed")
+	fmt.Println(" txindex [-drop] - Builds the transaction index from scratch, or drops it")
+	fmt.Println(" addrindex [-drop] - Builds the address index from scratch, or drops it")
+	fmt.Println(" listunspent -address <ADDRESS> - Lists the unspent outputs of an address")
+	fmt.Println(" addresshistory -address <ADDRESS> - Lists the payments to and from an address, needs addrindex")
+	fmt.Println(" getblock -hash <HASH> - Prints a block")
+	fmt.Println(" disconnectblocks [-count <N>] - Removes the last N blocks from the main chain, undoing their transactions")
+	fmt.Println(" prune -depth <N> - Keeps the transactions of the last N blocks only, older blocks keep their header")
+	fmt.Println(" verifychain [-depth <N> -level 0-3] - Checks the last N blocks (0 for all): seals and links, transactions, signatures, the UTXO set")
+	fmt.Println(" dumputxo -file <FILE> - Writes a snapshot of the UTXO set and prints its hash")
+	fmt.Println(" loadutxo -file <FILE> [-hash <HASH> -blocks <CHAIN FILE>] - Starts the blockchain from a snapshot with a trusted hash (or BLOCKCHAIN_TRUSTED_UTXO), backfilling blocks from an exported chain in the background")
+	fmt.Println(" backfill -blocks <CHAIN FILE> - Brings back the blocks below the snapshot the blockchain was started from, in the background")
+	fmt.Println(" exportchain -file <FILE> [-gzip] - Writes the blocks from genesis to a portable file")
+	fmt.Println(" importchain -file <FILE> - Creates the blockchain from an exported file, validating every block")
+	fmt.Println(" notarize -file <FILE> -address <ADDRESS> - timestamps the hash of a file on the blockchain")
+	fmt.Println(" verifynotary -file <FILE> - proves that the hash of a file is on the blockchain")
+	fmt.Println(" vote -address <ADDRESS> -signer <SIGNER> [-remove] - votes to add or remove a proof of authority signer")
 }
 
 //func to Validate arguments input through command line
@@ -40,14 +82,18 @@ func (cli *CommandLine) printBlockchain() {
 	chain := blockchain.ContinueBlockchain("")
 	defer chain.Database.Close()
 	itr := chain.Iterator()
+	defer itr.Close()
 	for {
 		block := itr.Next()
 		fmt.Printf("Previous Hash : %x\n", block.PrevHash)
 		fmt.Printf("Hash : %x\n", block.Hash)
 
-		pow := blockchain.Proof(block)
-		fmt.Printf("PoW : %s\n", strconv.FormatBool(pow.Validate()))
+		valid := chain.Engine.VerifySeal(chain, block) == nil
+		fmt.Printf("%s : %s\n", strings.ToUpper(chain.Engine.Name()), strconv.FormatBool(valid))
 
+		if block.Pruned() {
+			fmt.Println("Transactions pruned")
+		}
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
@@ -63,110 +109,1050 @@ func (cli *CommandLine) printBlockchain() {
 }
 
 //create the blockchain
-func (cli *CommandLine) createBlockchain(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Invalid Address!!")
+func (cli *CommandLine) createBlockchain(address, consensus, signers string, txindex, addrindex bool) {
+	checkAddress(address)
+
+	var engine blockchain.ConsensusEngine
+	switch consensus {
+	case "pow":
+		engine = blockchain.PoWEngine{}
+	case "poa":
+		var pubKeyHashes [][]byte
+		for _, signer := range strings.Split(signers, ",") {
+			checkAddress(signer)
+			pubKeyHashes = append(pubKeyHashes, addressPubKeyHash(signer))
+		}
+		poa := blockchain.NewPoAEngine(pubKeyHashes)
+		authorizeSigners(poa)
+		engine = poa
+	default:
+		log.Panic("Unknown consensus engine!!")
 	}
-	chain := blockchain.InitBlockchain(address)
-	chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	chain := blockchain.InitBlockchain(address, engine)
+	printMined(chain, chain.LastHash())
+	if txindex {
+		blockchain.Handle(chain.BuildIndex("txindex"))
+	}
+	if addrindex {
+		blockchain.Handle(chain.BuildIndex("addrindex"))
+	}
+	chain.Database.Close()
 
 	fmt.Println("\nBlockchain Created!!")
 }
 
-// Get all unspent transac and get balance
-func (cli *CommandLine) getBalance(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Invalid Address!!")
+// Get all unspent transac and get balance
+func (cli *CommandLine) getBalance(address string) {
+	checkAddress(address)
+
+	chain := blockchain.ContinueBlockchain(address)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	//addresses of the wallet are answered by its index
+	if wallets, _ := wallet.CreateWallets(); wallets.Tracks(address) {
+		if wallets, synced := syncWallet(chain); synced {
+			fmt.Printf("Balance of account %s is %d\n", address, wallets.Balance(address))
+			return
+		}
+	}
+
+	pubKeyHash := addressPubKeyHash(address)
+	if bal, err := chain.AddressBalance(pubKeyHash); err != blockchain.ErrIndexDisabled {
+		blockchain.Handle(err)
+		fmt.Printf("Balance of account %s is %d\n", address, bal)
+		return
+	}
+
+	bal := 0
+	UTXouts := UTXOSet.FindUTXOut(pubKeyHash)
+
+	for _, out := range UTXouts {
+		bal += out.Value
+	}
+
+	fmt.Printf("Balance of account %s is %d\n", address, bal)
+}
+
+//send tokens from one acct to other
+func (cli *CommandLine) send(from, to string, amt int, strategy, utxos string) {
+	checkAddress(to, from)
+	control := coinControl(strategy, utxos)
+
+	chain := blockchain.ContinueBlockchain(from)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+	authorizeSigners(chain.Engine)
+
+	tx, err := blockchain.NewTransactions(from, to, amt, &UTXOSet, control)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	coinBaseTxn := blockchain.CoinbaseTx(from, "")
+	block := chain.AddBlock([]*blockchain.Transaction{coinBaseTxn, tx})
+	printMined(chain, block.Hash)
+	syncWallet(chain)
+	fmt.Println("Transaction successful!!")
+}
+
+//pay every address of payments in one transaction
+func (cli *CommandLine) sendMany(from, payments, strategy, utxos string) {
+	checkAddress(from)
+	control := coinControl(strategy, utxos)
+	parsed, err := parsePayments(payments)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+
+	chain := blockchain.ContinueBlockchain(from)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+	authorizeSigners(chain.Engine)
+
+	tx, err := blockchain.NewTransactionMany(from, parsed, &UTXOSet, control)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	coinBaseTxn := blockchain.CoinbaseTx(from, "")
+	block := chain.AddBlock([]*blockchain.Transaction{coinBaseTxn, tx})
+	printMined(chain, block.Hash)
+	syncWallet(chain)
+	fmt.Printf("Transaction %x paid %d addresses\n", tx.ID, len(parsed))
+}
+
+func (cli *CommandLine) listAddresses(bech32 bool) {
+	wallets, _ := wallet.CreateWallets()
+	addresses := wallets.GetAllAddresses()
+
+	for _, address := range addresses {
+		if bech32 {
+			address = bech32Address(address)
+		}
+		fmt.Println(address)
+	}
+	for _, address := range wallets.WatchOnlyAddresses() {
+		if bech32 {
+			address = bech32Address(address)
+		}
+		fmt.Printf("%s (watch-only)\n", address)
+	}
+}
+
+//build an index (txindex or addrindex) from scratch, or drop it
+func (cli *CommandLine) buildIndex(name string, drop bool) {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	if drop {
+		blockchain.Handle(chain.DropIndex(name))
+		fmt.Printf("Dropped %s\n", name)
+		return
+	}
+	blockchain.Handle(chain.BuildIndex(name))
+	fmt.Printf("Built %s over %d blocks\n", name, len(chain.BlockHashes()))
+}
+
+func (cli *CommandLine) getBlock(hash string) {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		fmt.Println("Invalid block hash")
+		runtime.Goexit()
+	}
+	block, err := chain.GetBlock(blockHash)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	fmt.Printf("Previous Hash : %x\n", block.PrevHash)
+	fmt.Printf("Hash : %x\n", block.Hash)
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+}
+
+//take the tip blocks off the chain, they stay in the database
+func (cli *CommandLine) disconnectBlocks(count int) {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	for i := 0; i < count; i++ {
+		block, err := chain.DisconnectTip()
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		fmt.Printf("Disconnected block %x\n", block.Hash)
+	}
+	syncWallet(chain)
+}
+
+func (cli *CommandLine) prune(depth int) {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	pruned, err := chain.EnablePruning(depth)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	fmt.Printf("Pruned %d blocks, the last %d keep their transactions\n", pruned, depth)
+}
+
+func (cli *CommandLine) verifyChain(depth, level int) {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	checked, err := chain.VerifyChain(depth, level)
+	if err != nil {
+		fmt.Printf("Checked %d blocks, then found: %v\n", checked, err)
+		runtime.Goexit()
+	}
+	fmt.Printf("Verified %d blocks at level %d\n", checked, level)
+}
+
+func (cli *CommandLine) dumpUTXO(file string) {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	f, err := os.Create(file)
+	blockchain.Handle(err)
+	defer f.Close()
+
+	info, err := chain.DumpUTXO(f)
+	blockchain.Handle(err)
+	fmt.Printf("Wrote %d transactions at height %d, tip %x\n", info.Entries, info.Height, info.TipHash)
+	fmt.Printf("Snapshot hash : %x\n", info.Hash)
+}
+
+func (cli *CommandLine) loadUTXO(file, trusted, blocks string) {
+	trustedHash, err := hex.DecodeString(trusted)
+	if err != nil || len(trustedHash) == 0 {
+		fmt.Println("A trusted snapshot hash is needed, pass -hash or set BLOCKCHAIN_TRUSTED_UTXO")
+		runtime.Goexit()
+	}
+	f, err := os.Open(file)
+	blockchain.Handle(err)
+	defer f.Close()
+
+	chain, info, err := blockchain.LoadUTXO(f, trustedHash)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	fmt.Printf("Loaded %d transactions, the blockchain starts at height %d, tip %x\n", info.Entries, info.Height, info.TipHash)
+	chain.Database.Close()
+
+	if blocks != "" {
+		startBackfill(blocks)
+	}
+}
+
+func (cli *CommandLine) backfill(blocks string) {
+	chain := blockchain.ContinueBlockchain("")
+	fromSnapshot := chain.FromSnapshot()
+	chain.Database.Close()
+	if !fromSnapshot {
+		fmt.Println("The blockchain wasn't loaded from a snapshot or is already backfilled")
+		runtime.Goexit()
+	}
+	startBackfill(blocks)
+}
+
+//restore the blocks below the snapshot in a background process
+func startBackfill(blocks string) {
+	if err := blockchain.StartBackfill(blocks); err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	fmt.Printf("Backfilling in the background, progress is written to %s\n", blockchain.BackfillLog)
+}
+
+//the background process started by startBackfill
+func (cli *CommandLine) runBackfill(blocks string) {
+	if err := blockchain.RunBackfill(blocks); err != nil {
+		fmt.Printf("Backfill stopped: %v\n", err)
+		runtime.Goexit()
+	}
+	fmt.Println("Backfill done, the blocks match the snapshot")
+}
+
+func (cli *CommandLine) exportChain(file string, compress bool) {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	f, err := os.Create(file)
+	blockchain.Handle(err)
+	defer f.Close()
+
+	count, err := chain.ExportChain(f, compress)
+	blockchain.Handle(err)
+	fmt.Printf("Exported %d blocks to %s\n", count, file)
+}
+
+func (cli *CommandLine) importChain(file string) {
+	f, err := os.Open(file)
+	blockchain.Handle(err)
+	defer f.Close()
+
+	chain, count, err := blockchain.ImportChain(f)
+	if chain != nil {
+		defer chain.Database.Close()
+	}
+	if err != nil {
+		fmt.Printf("Imported %d blocks, then: %v\n", count, err)
+		runtime.Goexit()
+	}
+	fmt.Printf("Imported %d blocks\n", count)
+}
+
+//unspent outputs of an address
+func (cli *CommandLine) listUnspent(address string) {
+	checkAddress(address)
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	pubKeyHash := addressPubKeyHash(address)
+	utxos, err := chain.AddressUTXOs(pubKeyHash)
+	if err == blockchain.ErrIndexDisabled {
+		utxos, err = blockchain.UTXOSet{Blockchain: chain}.FindSpendableOutputs(pubKeyHash), nil
+	}
+	blockchain.Handle(err)
+	for _, utxo := range utxos {
+		fmt.Printf("%s : %d\n", utxo, utxo.Value)
+	}
+}
+
+//funding and spending events of an address, needs the address index
+func (cli *CommandLine) addressHistory(address string) {
+	checkAddress(address)
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	events, err := chain.AddressHistory(addressPubKeyHash(address))
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	for _, event := range events {
+		if event.Spend {
+			fmt.Printf("Height %d : spent %d in %x input %d (%x:%d)\n", event.Height, event.Value, event.TxID, event.Index, event.PrevTxID, event.PrevIndex)
+		} else {
+			fmt.Printf("Height %d : received %d in %x:%d\n", event.Height, event.Value, event.TxID, event.Index)
+		}
+	}
+}
+
+func (cli *CommandLine) getTxOutSetInfo() {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	stats, err := blockchain.UTXOSet{Blockchain: chain}.Stats()
+	blockchain.Handle(err)
+	fmt.Printf("Tip       : %x\n", chain.LastHash())
+	fmt.Printf("Height    : %d\n", len(chain.BlockHashes())-1)
+	fmt.Printf("Outputs   : %d\n", stats.Count)
+	fmt.Printf("Total     : %d\n", stats.Total)
+	fmt.Printf("Set hash  : %x\n", stats.Hash())
+}
+
+func (cli *CommandLine) migrateDB(dryRun bool) {
+	if !blockchain.DBexists() {
+		fmt.Println("No existing database found, create one")
+		runtime.Goexit()
+	}
+	steps, err := blockchain.MigrateDatabase(dryRun)
+	for _, step := range steps {
+		if dryRun {
+			fmt.Printf("Would migrate to schema version %d: %s\n", step.Version, step.Description)
+		} else {
+			fmt.Printf("Migrated to schema version %d: %s\n", step.Version, step.Description)
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	if len(steps) == 0 {
+		fmt.Printf("The database is at schema version %d, nothing to migrate\n", blockchain.SchemaVersion)
+	}
+}
+
+func (cli *CommandLine) reindexUTXO() {
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+	if chain.HasPrunedBlocks() {
+		fmt.Println("The UTXO set can't be rebuilt, some blocks only have their header")
+		runtime.Goexit()
+	}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+
+	count := UTXOSet.CountTransacs()
+	fmt.Printf("There are %d transactions in the UTXO set\n", count)
+}
+
+//hash a file and embed it in a new block mined by address
+func (cli *CommandLine) notarize(file, address string) {
+	checkAddress(address)
+	digest := fileDigest(file)
+
+	chain := blockchain.ContinueBlockchain(address)
+	defer chain.Database.Close()
+	authorizeSigners(chain.Engine)
+
+	tx, err := blockchain.NotaryTx(address, digest)
+	blockchain.Handle(err)
+	block := chain.AddBlock([]*blockchain.Transaction{tx})
+	printMined(chain, block.Hash)
+	syncWallet(chain)
+
+	fmt.Printf("Notarized %x in block %x\n", digest, block.Hash)
+}
+
+//find the block holding the hash of a file and check its Merkle proof
+func (cli *CommandLine) verifyNotary(file string) {
+	digest := fileDigest(file)
+
+	chain := blockchain.ContinueBlockchain("")
+	defer chain.Database.Close()
+
+	block, tx, proof, err := chain.FindData(digest)
+	if err != nil {
+		fmt.Printf("%x is not notarized\n", digest)
+		return
+	}
+	valid := chain.Engine.VerifySeal(chain, block) == nil && block.VerifyProof(tx, proof)
+
+	fmt.Printf("Hash         : %x\n", digest)
+	fmt.Printf("Block        : %x\n", block.Hash)
+	fmt.Printf("Transaction  : %x\n", tx.ID)
+	fmt.Printf("Position     : %d\n", proof.Index)
+	for _, hash := range proof.Hashes {
+		fmt.Printf("Merkle path  : %x\n", hash)
+	}
+	fmt.Printf("Proof valid  : %s\n", strconv.FormatBool(valid))
+}
+
+//mine a block carrying a vote on a proof of authority signer
+func (cli *CommandLine) vote(address, signer string, authorize bool) {
+	checkAddress(address, signer)
+
+	chain := blockchain.ContinueBlockchain(address)
+	defer chain.Database.Close()
+	if _, ok := chain.Engine.(*blockchain.PoAEngine); !ok {
+		log.Panic("Voting needs a proof of authority blockchain!!")
+	}
+	authorizeSigners(chain.Engine)
+
+	tx, err := blockchain.VoteTx(address, addressPubKeyHash(signer), authorize)
+	blockchain.Handle(err)
+	block := chain.AddBlock([]*blockchain.Transaction{tx})
+	printMined(chain, block.Hash)
+	syncWallet(chain)
+
+	fmt.Printf("Vote cast in block %x\n", block.Hash)
+}
+
+//hash of a block the chain just mined and how fast it was found, blocks
+//sealed without proof of work print nothing
+func printMined(chain *blockchain.Blockchain, hash []byte) {
+	if rate := chain.HashRate(); rate > 0 {
+		fmt.Printf("%x (%.0f H/s)\n", hash, rate)
+	}
+}
+
+//let a proof of authority engine seal with the keys in the wallet file
+func authorizeSigners(engine blockchain.ConsensusEngine) {
+	poa, ok := engine.(*blockchain.PoAEngine)
+	if !ok {
+		return
+	}
+	wallets, _ := wallet.CreateWallets()
+	for _, address := range wallets.GetAllAddresses() {
+		if key, err := wallets.PrivateKey(address); err == nil {
+			poa.Authorize(key)
+		}
+	}
+}
+
+//stop with the reason when an address is invalid
+func checkAddress(addresses ...string) {
+	for _, address := range addresses {
+		if _, err := wallet.AddressPubKeyHash(address); err != nil {
+			fmt.Printf("%s : %v\n", address, err)
+			runtime.Goexit()
+		}
+	}
+}
+
+//strip version and checksum from an address
+func addressPubKeyHash(address string) []byte {
+	pubKeyHash, err := wallet.AddressPubKeyHash(address)
+	blockchain.Handle(err)
+	return pubKeyHash
+}
+
+//Payments as a JSON object {"<ADDRESS>": <AMOUNT>, ...}, a JSON list
+//[{"address": "<ADDRESS>", "amount": <AMOUNT>}, ...] or a comma
+//separated <ADDRESS>=<AMOUNT> list
+func parsePayments(s string) ([]blockchain.Payment, error) {
+	var payments []blockchain.Payment
+	s = strings.TrimSpace(s)
+
+	switch {
+	case strings.HasPrefix(s, "{"):
+		//read the object key by key, a map would silently keep only the
+		//last of duplicate addresses
+		dec := json.NewDecoder(strings.NewReader(s))
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			var amount int
+			if err := dec.Decode(&amount); err != nil {
+				return nil, fmt.Errorf("payment to %v: %v", key, err)
+			}
+			payments = append(payments, blockchain.Payment{To: key.(string), Amount: amount})
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, errors.New("unexpected data after the payments")
+		}
+	case strings.HasPrefix(s, "["):
+		var list []struct {
+			Address string
+			Amount  int
+		}
+		if err := json.Unmarshal([]byte(s), &list); err != nil {
+			return nil, err
+		}
+		for _, entry := range list {
+			payments = append(payments, blockchain.Payment{To: entry.Address, Amount: entry.Amount})
+		}
+	default:
+		for _, entry := range strings.Split(s, ",") {
+			parts := strings.Split(strings.TrimSpace(entry), "=")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("payment %q is not <ADDRESS>=<AMOUNT>", entry)
+			}
+			amount, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("payment %q has an invalid amount", entry)
+			}
+			payments = append(payments, blockchain.Payment{To: parts[0], Amount: amount})
+		}
+	}
+	//addresses and amounts are checked by NewTransactionMany
+	return payments, nil
+}
+
+//coin selection strategy and comma separated txid:index outpoints
+func coinControl(strategy, utxos string) blockchain.CoinControl {
+	control := blockchain.CoinControl{Strategy: blockchain.CoinSelection(strategy)}
+	if !control.Strategy.IsValid() {
+		fmt.Printf("unknown coin selection %q\n", strategy)
+		runtime.Goexit()
+	}
+	if utxos == "" {
+		return control
+	}
+	for _, s := range strings.Split(utxos, ",") {
+		outpoint, err := blockchain.ParseOutpoint(strings.TrimSpace(s))
+		if err != nil {
+			fmt.Println(err)
+			runtime.Goexit()
+		}
+		control.Outpoints = append(control.Outpoints, outpoint)
+	}
+	return control
+}
+
+func fileDigest(file string) []byte {
+	content, err := ioutil.ReadFile(file)
+	blockchain.Handle(err)
+	digest := sha256.Sum256(content)
+	return digest[:]
+}
+
+func (cli *CommandLine) createWallet(bech32 bool) {
+	wallets, _ := wallet.CreateWallets()
+	address, err := wallets.AddWallet()
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	wallets.SaveFile()
+
+	if bech32 {
+		address = bech32Address(address)
+	}
+	fmt.Printf("New address is %s", address)
+}
+
+//Bech32 form of a valid address
+func bech32Address(address string) string {
+	address, err := wallet.Bech32Address(addressPubKeyHash(address))
+	blockchain.Handle(err)
+	return address
+}
+
+//encrypt the private keys in the wallet file
+func (cli *CommandLine) encryptWallet(passphrase string) {
+	wallets, _ := wallet.CreateWallets()
+	if err := wallets.Encrypt(passphrase); err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	fmt.Println("Wallet encrypted, unlock it with walletpassphrase to send")
+}
+
+//unlock the wallet for the following commands until timeout
+func (cli *CommandLine) walletPassphrase(passphrase string, timeout int) {
+	wallets, _ := wallet.CreateWallets()
+	duration := time.Duration(timeout) * time.Second
+	if err := wallets.Unlock(passphrase, duration); err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	blockchain.Handle(wallets.StartSession(duration))
+	fmt.Printf("Wallet unlocked for %d seconds\n", timeout)
+}
+
+//set up an HD seed, restoring from mnemonic when it is given
+func (cli *CommandLine) hdSetup(mnemonic string) {
+	wallets, _ := wallet.CreateWallets()
+	words, err := wallets.InitHD(mnemonic)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	wallets.SaveFile()
+
+	if mnemonic == "" {
+		fmt.Println("Write down this mnemonic, it restores every address of the wallet :")
+		fmt.Println(words)
+		return
+	}
+	fmt.Println("HD seed restored")
+	if blockchain.DBexists() {
+		cli.rescanHD()
+	}
+}
+
+func (cli *CommandLine) dumpMnemonic() {
+	wallets, _ := wallet.CreateWallets()
+	mnemonic, err := wallets.Mnemonic()
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	fmt.Println(mnemonic)
+}
+
+//add the HD addresses used on the blockchain to the wallet
+func (cli *CommandLine) rescanHD() {
+	chain := blockchain.ContinueBlockchain("")
+	used, err := chain.UsedPubKeyHashes()
+	chain.Database.Close()
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+
+	wallets, _ := wallet.CreateWallets()
+	found, err := wallets.DiscoverHD(func(pubKeyHash []byte) bool {
+		return used[hex.EncodeToString(pubKeyHash)]
+	})
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	wallets.SaveFile()
+	fmt.Printf("Found %d used addresses\n", found)
+	cli.rescan(0, nil)
+}
+
+func (cli *CommandLine) dumpPrivKey(address string) {
+	wallets, _ := wallet.CreateWallets()
+	key, err := wallets.DumpPrivKey(address)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	fmt.Println(key)
+}
+
+func (cli *CommandLine) importPrivKey(key string, rescan bool) {
+	wallets, _ := wallet.CreateWallets()
+	address, err := wallets.ImportPrivKey(key)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	wallets.SaveFile()
+
+	fmt.Printf("Imported address %s\n", address)
+	if rescan {
+		cli.rescan(0, []string{address})
+	}
+}
+
+//back up the whole wallet, the file holds unencrypted private keys
+func (cli *CommandLine) dumpWallet(file string) {
+	wallets, _ := wallet.CreateWallets()
+	content, err := wallets.Export()
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	blockchain.Handle(ioutil.WriteFile(file, content, 0600))
+	fmt.Printf("Wallet written to %s\n", file)
+}
+
+func (cli *CommandLine) importWallet(file string, rescan bool) {
+	content, err := ioutil.ReadFile(file)
+	blockchain.Handle(err)
+
+	wallets, _ := wallet.CreateWallets()
+	addresses, err := wallets.Import(content)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	wallets.SaveFile()
+
+	fmt.Printf("Imported %d keys\n", len(addresses))
+	if rescan {
+		if wallets.IsHD() && blockchain.DBexists() {
+			cli.rescanHD()
+		}
+		cli.rescan(0, addresses)
+	}
+}
+
+//rebuild the wallet history from fromHeight on and show the balances of addresses
+func (cli *CommandLine) rescan(fromHeight int, addresses []string) {
+	if !blockchain.DBexists() {
+		return
 	}
-
-	chain := blockchain.ContinueBlockchain(address)
-	UTXOSet := blockchain.UTXOSet{chain}
+	chain := blockchain.ContinueBlockchain("")
 	defer chain.Database.Close()
 
-	bal := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXouts := UTXOSet.FindUTXOut(pubKeyHash)
-
-	for _, out := range UTXouts {
-		bal += out.Value
+	wallets, _ := wallet.CreateWallets()
+	wallets.Rollback(fromHeight)
+	_, _, err := chain.SyncWallet(wallets)
+	wallets.SaveFile()
+	if err != nil {
+		fmt.Printf("Wallet synced up to height %d: %v\n", wallets.SyncedHeight(), err)
 	}
 
-	fmt.Printf("Balance of account %s is %d\n", address, bal)
+	for _, address := range addresses {
+		history := wallets.History(address)
+		fmt.Printf("Balance of account %s is %d (%d transactions)\n", address, wallets.Balance(address), len(history))
+	}
 }
 
-//send tokens from one acct to other
-func (cli *CommandLine) send(from, to string, amt int) {
-	if !wallet.ValidateAddress(to) || !wallet.ValidateAddress(from) {
-		log.Panic("Invalid Address!!")
+//bring the wallet index up to the chain tip, false when pruned blocks
+//keep it behind or the wallet file can't be read. The wallet file is only
+//written when the index changed
+func syncWallet(chain *blockchain.Blockchain) (*wallet.Wallets, bool) {
+	wallets, err := wallet.CreateWallets()
+	if err != nil && !os.IsNotExist(err) {
+		//saving would overwrite the unreadable file
+		fmt.Println("Wallet not synced:", err)
+		return wallets, false
+	}
+	disconnected, connected, err := chain.SyncWallet(wallets)
+	if disconnected > 0 || connected > 0 {
+		wallets.SaveFile()
 	}
+	if err != nil {
+		fmt.Printf("Wallet synced up to height %d: %v\n", wallets.SyncedHeight(), err)
+	}
+	return wallets, err == nil
+}
 
-	chain := blockchain.ContinueBlockchain(from)
-	UTXOSet := blockchain.UTXOSet{chain}
+//wallet transactions of address, newest first
+func (cli *CommandLine) listTransactions(address string, count, skip int) {
+	chain := blockchain.ContinueBlockchain("")
 	defer chain.Database.Close()
+	wallets, synced := syncWallet(chain)
+	if !synced {
+		runtime.Goexit()
+	}
+	if !wallets.Tracks(address) {
+		fmt.Println(wallet.ErrUnknownAddress)
+		runtime.Goexit()
+	}
 
-	tx := blockchain.NewTransactions(from, to, amt, &UTXOSet)
-	coinBaseTxn := blockchain.CoinbaseTx(from, "")
-	block := chain.AddBlock([]*blockchain.Transaction{coinBaseTxn, tx})
-	UTXOSet.Update(block)
-	fmt.Println("\nTransaction successful!!")
+	history := wallets.History(address)
+	tip := wallets.SyncedHeight()
+	for i := len(history) - 1 - skip; i >= 0 && count > 0; i, count = i-1, count-1 {
+		record := history[i]
+		fmt.Printf("Transaction : %x\n", record.TxID)
+		fmt.Printf("Block : %x\n", record.BlockHash)
+		fmt.Printf("Confirmations : %d\n", tip-record.Height+1)
+		fmt.Printf("Received : %d, Sent : %d, Change : %d, Fee : %d\n", record.Received, record.Sent, record.Change, record.Fee)
+		fmt.Println()
+	}
 }
 
-func (cli *CommandLine) listAddresses() {
+//track an address, or the address of a public key, without its private key
+func (cli *CommandLine) importAddress(address string, rescan bool) {
 	wallets, _ := wallet.CreateWallets()
-	addresses := wallets.GetAllAddresses()
+	address, err := wallets.ImportAddress(address)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	wallets.SaveFile()
 
-	for _, address := range addresses {
-		fmt.Println(address)
+	fmt.Printf("Watching address %s\n", address)
+	if rescan {
+		cli.rescan(0, []string{address})
 	}
 }
 
-func (cli *CommandLine) reindexUTXO() {
-	chain := blockchain.ContinueBlockchain("")
-	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
-
-	count := UTXOSet.CountTransacs()
-	fmt.Printf("There are %d transactions in the UTXO set\n", count)
+func (cli *CommandLine) rescanWallet(fromHeight int) {
+	wallets, _ := wallet.CreateWallets()
+	addresses := append(wallets.GetAllAddresses(), wallets.WatchOnlyAddresses()...)
+	cli.rescan(fromHeight, addresses)
 }
 
-func (cli *CommandLine) createWallet() {
+//prove control of address
+func (cli *CommandLine) signMessage(address, message string) {
 	wallets, _ := wallet.CreateWallets()
-	address := wallets.AddWallet()
-	wallets.SaveFile()
+	signature, err := wallets.SignMessage(address, message)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	fmt.Println(signature)
+}
 
-	fmt.Printf("New address is %s", address)
+func (cli *CommandLine) verifyMessage(address, signature, message string) {
+	if err := wallet.VerifyMessage(address, signature, message); err != nil {
+		fmt.Printf("Signature is not valid : %v\n", err)
+		runtime.Goexit()
+	}
+	fmt.Println("Signature is valid")
+}
+
+func (cli *CommandLine) walletLock() {
+	blockchain.Handle(wallet.EndSession())
+	fmt.Println("Wallet locked")
 }
 
 // run cli commands
 func (cli *CommandLine) Run() {
 	cli.ValidateArgs()
 
+	//addresses are checked against the network in BLOCKCHAIN_NETWORK, main by default
+	if network := os.Getenv("BLOCKCHAIN_NETWORK"); network != "" {
+		if err := wallet.SetNetwork(network); err != nil {
+			fmt.Println(err)
+			runtime.Goexit()
+		}
+	}
+
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	sendManyCmd := flag.NewFlagSet("sendmany", flag.ExitOnError)
 	printCmd := flag.NewFlagSet("print", flag.ExitOnError)
 
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	encryptWalletCmd := flag.NewFlagSet("encryptwallet", flag.ExitOnError)
+	walletPassphraseCmd := flag.NewFlagSet("walletpassphrase", flag.ExitOnError)
+	walletLockCmd := flag.NewFlagSet("walletlock", flag.ExitOnError)
+	walletAgentCmd := flag.NewFlagSet(wallet.AgentCommand, flag.ExitOnError)
+	dumpPrivKeyCmd := flag.NewFlagSet("dumpprivkey", flag.ExitOnError)
+	importPrivKeyCmd := flag.NewFlagSet("importprivkey", flag.ExitOnError)
+	dumpWalletCmd := flag.NewFlagSet("dumpwallet", flag.ExitOnError)
+	importWalletCmd := flag.NewFlagSet("importwallet", flag.ExitOnError)
+	importAddressCmd := flag.NewFlagSet("importaddress", flag.ExitOnError)
+	rescanWalletCmd := flag.NewFlagSet("rescanwallet", flag.ExitOnError)
+	listTransactionsCmd := flag.NewFlagSet("listtransactions", flag.ExitOnError)
+	signMessageCmd := flag.NewFlagSet("signmessage", flag.ExitOnError)
+	verifyMessageCmd := flag.NewFlagSet("verifymessage", flag.ExitOnError)
+	hdSetupCmd := flag.NewFlagSet("hdsetup", flag.ExitOnError)
+	dumpMnemonicCmd := flag.NewFlagSet("dumpmnemonic", flag.ExitOnError)
+	rescanHDCmd := flag.NewFlagSet("rescanhd", flag.ExitOnError)
 
 	reindexUTXOCmd := flag.NewFlagSet("reindexUTXO", flag.ExitOnError)
+	getTxOutSetInfoCmd := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+	txIndexCmd := flag.NewFlagSet("txindex", flag.ExitOnError)
+	addrIndexCmd := flag.NewFlagSet("addrindex", flag.ExitOnError)
+	listUnspentCmd := flag.NewFlagSet("listunspent", flag.ExitOnError)
+	addressHistoryCmd := flag.NewFlagSet("addresshistory", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	disconnectBlocksCmd := flag.NewFlagSet("disconnectblocks", flag.ExitOnError)
+	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
+	backfillCmd := flag.NewFlagSet("backfill", flag.ExitOnError)
+	backfillWorkerCmd := flag.NewFlagSet(blockchain.BackfillCommand, flag.ExitOnError)
+	exportChainCmd := flag.NewFlagSet("exportchain", flag.ExitOnError)
+	importChainCmd := flag.NewFlagSet("importchain", flag.ExitOnError)
+
+	notarizeCmd := flag.NewFlagSet("notarize", flag.ExitOnError)
+	verifyNotaryCmd := flag.NewFlagSet("verifynotary", flag.ExitOnError)
+	voteCmd := flag.NewFlagSet("vote", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address of account")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to create Blockchain")
+	createBlockchainConsensus := createBlockchainCmd.String("consensus", "pow", "Consensus engine, pow or poa")
+	createBlockchainSigners := createBlockchainCmd.String("signers", "", "Comma separated proof of authority signer addresses")
+	createBlockchainTxIndex := createBlockchainCmd.Bool("txindex", false, "Keep an index of transactions by id")
+	createBlockchainAddrIndex := createBlockchainCmd.Bool("addrindex", false, "Keep an index of payments by address")
+	migrateDBDryRun := migrateDBCmd.Bool("dry-run", false, "Only check the migrations can run, leaving the database as it is")
+	txIndexDrop := txIndexCmd.Bool("drop", false, "Delete the index instead of building it")
+	addrIndexDrop := addrIndexCmd.Bool("drop", false, "Delete the index instead of building it")
+	listUnspentAddress := listUnspentCmd.String("address", "", "The address of account")
+	addressHistoryAddress := addressHistoryCmd.String("address", "", "The address of account")
+	getBlockHash := getBlockCmd.String("hash", "", "Hash of the block")
+	disconnectBlocksCount := disconnectBlocksCmd.Int("count", 1, "Number of blocks to disconnect")
+	pruneDepth := pruneCmd.Int("depth", 0, "Number of recent blocks that keep their transactions")
+	verifyChainDepth := verifyChainCmd.Int("depth", 6, "Number of blocks to check from the tip, 0 for all")
+	verifyChainLevel := verifyChainCmd.Int("level", blockchain.VerifySignatures, "0 seals and links, 1 transactions, 2 signatures, 3 UTXO set")
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "Snapshot file to write")
+	loadUTXOFile := loadUTXOCmd.String("file", "", "Snapshot file to read")
+	loadUTXOHash := loadUTXOCmd.String("hash", os.Getenv("BLOCKCHAIN_TRUSTED_UTXO"), "Trusted hash of the snapshot")
+	loadUTXOBlocks := loadUTXOCmd.String("blocks", "", "Exported chain to backfill the blocks from")
+	backfillBlocks := backfillCmd.String("blocks", "", "Exported chain to backfill the blocks from")
+	backfillWorkerBlocks := backfillWorkerCmd.String("blocks", "", "Exported chain to backfill the blocks from")
+	exportChainFile := exportChainCmd.String("file", "", "Chain file to write")
+	exportChainGzip := exportChainCmd.Bool("gzip", false, "Compress the chain file")
+	importChainFile := importChainCmd.String("file", "", "Chain file to read, gzipped or not")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmt := sendCmd.Int("amount", 0, "Amount to send")
+	sendStrategy := sendCmd.String("strategy", string(blockchain.SelectLargestFirst), "Coin selection: largest-first, smallest-first, branch-and-bound or random-improve")
+	sendUTXOs := sendCmd.String("utxos", "", "Comma separated txid:index outputs to spend")
+	createWalletBech32 := createWalletCmd.Bool("bech32", false, "Print the address in Bech32 format")
+	listAddressesBech32 := listAddressesCmd.Bool("bech32", false, "Print the addresses in Bech32 format")
+	sendManyFrom := sendManyCmd.String("from", "", "Source wallet address")
+	sendManyPayments := sendManyCmd.String("payments", "", "ADDRESS=AMOUNT list or JSON")
+	sendManyStrategy := sendManyCmd.String("strategy", string(blockchain.SelectLargestFirst), "Coin selection: largest-first, smallest-first, branch-and-bound or random-improve")
+	sendManyUTXOs := sendManyCmd.String("utxos", "", "Comma separated txid:index outputs to spend")
+	encryptWalletPassphrase := encryptWalletCmd.String("passphrase", "", "Passphrase protecting the wallet")
+	walletPassphrasePassphrase := walletPassphraseCmd.String("passphrase", "", "Passphrase of the wallet")
+	walletPassphraseTimeout := walletPassphraseCmd.Int("timeout", 60, "Seconds to keep the wallet unlocked")
+	walletAgentTimeout := walletAgentCmd.Int("timeout", 60, "Seconds to keep the key")
+	dumpPrivKeyAddress := dumpPrivKeyCmd.String("address", "", "The address of the key")
+	importPrivKeyKey := importPrivKeyCmd.String("key", "", "Private key printed by dumpprivkey")
+	importPrivKeyRescan := importPrivKeyCmd.Bool("rescan", true, "Look up the balance of the key on the blockchain")
+	dumpWalletFile := dumpWalletCmd.String("file", "", "Backup file to write")
+	importWalletFile := importWalletCmd.String("file", "", "Backup file to read")
+	importWalletRescan := importWalletCmd.Bool("rescan", true, "Look up the balance of the keys on the blockchain")
+	importAddressAddress := importAddressCmd.String("address", "", "Address or hex public key to watch")
+	importAddressRescan := importAddressCmd.Bool("rescan", true, "Look up the transactions of the address on the blockchain")
+	rescanWalletFromHeight := rescanWalletCmd.Int("from-height", 0, "Height of the first block to scan")
+	listTransactionsAddress := listTransactionsCmd.String("address", "", "The address of account")
+	listTransactionsCount := listTransactionsCmd.Int("count", 10, "Number of transactions to list")
+	listTransactionsSkip := listTransactionsCmd.Int("skip", 0, "Number of most recent transactions to skip")
+	signMessageAddress := signMessageCmd.String("address", "", "The address signing")
+	signMessageMessage := signMessageCmd.String("message", "", "Message to sign")
+	verifyMessageAddress := verifyMessageCmd.String("address", "", "The address that signed")
+	verifyMessageSignature := verifyMessageCmd.String("signature", "", "Signature printed by signmessage")
+	verifyMessageMessage := verifyMessageCmd.String("message", "", "Message that was signed")
+	hdSetupMnemonic := hdSetupCmd.String("mnemonic", "", "Mnemonic of the seed to restore")
+	notarizeFile := notarizeCmd.String("file", "", "File to notarize")
+	notarizeAddress := notarizeCmd.String("address", "", "The address mining the notary block")
+	verifyNotaryFile := verifyNotaryCmd.String("file", "", "File to verify")
+	voteAddress := voteCmd.String("address", "", "The address receiving the block reward")
+	voteSigner := voteCmd.String("signer", "", "The signer address voted on")
+	voteRemove := voteCmd.Bool("remove", false, "Vote to remove the signer instead of adding it")
 
 	switch os.Args[1] {
 	case "reindexUTXO":
 		err := reindexUTXOCmd.Parse(os.Args[2:])
 		blockchain.Handle(err)
 
+	case "gettxoutsetinfo":
+		err := getTxOutSetInfoCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "migratedb":
+		err := migrateDBCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "txindex":
+		err := txIndexCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "addrindex":
+		err := addrIndexCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "listunspent":
+		err := listUnspentCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "addresshistory":
+		err := addressHistoryCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "getblock":
+		err := getBlockCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "disconnectblocks":
+		err := disconnectBlocksCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "prune":
+		err := pruneCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "verifychain":
+		err := verifyChainCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "dumputxo":
+		err := dumpUTXOCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "loadutxo":
+		err := loadUTXOCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "backfill":
+		err := backfillCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	//started by backfill and loadutxo, not meant to be run by hand
+	case blockchain.BackfillCommand:
+		err := backfillWorkerCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "exportchain":
+		err := exportChainCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "importchain":
+		err := importChainCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		blockchain.Handle(err)
@@ -179,6 +1165,10 @@ func (cli *CommandLine) Run() {
 		err := sendCmd.Parse(os.Args[2:])
 		blockchain.Handle(err)
 
+	case "sendmany":
+		err := sendManyCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
 	case "print":
 		err := printCmd.Parse(os.Args[2:])
 		blockchain.Handle(err)
@@ -191,6 +1181,83 @@ func (cli *CommandLine) Run() {
 		err := listAddressesCmd.Parse(os.Args[2:])
 		blockchain.Handle(err)
 
+	case "encryptwallet":
+		err := encryptWalletCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "walletpassphrase":
+		err := walletPassphraseCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "walletlock":
+		err := walletLockCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	//started by walletpassphrase, not meant to be run by hand
+	case wallet.AgentCommand:
+		err := walletAgentCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "dumpprivkey":
+		err := dumpPrivKeyCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "importprivkey":
+		err := importPrivKeyCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "dumpwallet":
+		err := dumpWalletCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "importwallet":
+		err := importWalletCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "importaddress":
+		err := importAddressCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "rescanwallet":
+		err := rescanWalletCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "listtransactions":
+		err := listTransactionsCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "signmessage":
+		err := signMessageCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "verifymessage":
+		err := verifyMessageCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "hdsetup":
+		err := hdSetupCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "dumpmnemonic":
+		err := dumpMnemonicCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "rescanhd":
+		err := rescanHDCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "notarize":
+		err := notarizeCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "verifynotary":
+		err := verifyNotaryCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
+	case "vote":
+		err := voteCmd.Parse(os.Args[2:])
+		blockchain.Handle(err)
+
 	default:
 		cli.printUsage()
 		runtime.Goexit()
@@ -210,7 +1277,11 @@ func (cli *CommandLine) Run() {
 			createBlockchainCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.createBlockchain(*createBlockchainAddress)
+		if *createBlockchainConsensus == "poa" && *createBlockchainSigners == "" {
+			createBlockchainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createBlockchain(*createBlockchainAddress, *createBlockchainConsensus, *createBlockchainSigners, *createBlockchainTxIndex, *createBlockchainAddrIndex)
 	}
 
 	if sendCmd.Parsed() {
@@ -218,7 +1289,15 @@ func (cli *CommandLine) Run() {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmt)
+		cli.send(*sendFrom, *sendTo, *sendAmt, *sendStrategy, *sendUTXOs)
+	}
+
+	if sendManyCmd.Parsed() {
+		if *sendManyFrom == "" || *sendManyPayments == "" {
+			sendManyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.sendMany(*sendManyFrom, *sendManyPayments, *sendManyStrategy, *sendManyUTXOs)
 	}
 
 	if printCmd.Parsed() {
@@ -226,13 +1305,253 @@ func (cli *CommandLine) Run() {
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		cli.createWallet(*createWalletBech32)
 	}
 
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses()
+		cli.listAddresses(*listAddressesBech32)
+	}
+
+	if encryptWalletCmd.Parsed() {
+		if *encryptWalletPassphrase == "" {
+			encryptWalletCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.encryptWallet(*encryptWalletPassphrase)
+	}
+
+	if walletPassphraseCmd.Parsed() {
+		if *walletPassphrasePassphrase == "" || *walletPassphraseTimeout <= 0 {
+			walletPassphraseCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.walletPassphrase(*walletPassphrasePassphrase, *walletPassphraseTimeout)
+	}
+
+	if walletLockCmd.Parsed() {
+		cli.walletLock()
+	}
+
+	if walletAgentCmd.Parsed() {
+		blockchain.Handle(wallet.RunAgent(time.Duration(*walletAgentTimeout) * time.Second))
+	}
+
+	if dumpPrivKeyCmd.Parsed() {
+		if *dumpPrivKeyAddress == "" {
+			dumpPrivKeyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.dumpPrivKey(*dumpPrivKeyAddress)
+	}
+
+	if importPrivKeyCmd.Parsed() {
+		if *importPrivKeyKey == "" {
+			importPrivKeyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importPrivKey(*importPrivKeyKey, *importPrivKeyRescan)
+	}
+
+	if dumpWalletCmd.Parsed() {
+		if *dumpWalletFile == "" {
+			dumpWalletCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.dumpWallet(*dumpWalletFile)
+	}
+
+	if importWalletCmd.Parsed() {
+		if *importWalletFile == "" {
+			importWalletCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importWallet(*importWalletFile, *importWalletRescan)
+	}
+
+	if importAddressCmd.Parsed() {
+		if *importAddressAddress == "" {
+			importAddressCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importAddress(*importAddressAddress, *importAddressRescan)
+	}
+
+	if rescanWalletCmd.Parsed() {
+		if *rescanWalletFromHeight < 0 {
+			rescanWalletCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.rescanWallet(*rescanWalletFromHeight)
+	}
+
+	if listTransactionsCmd.Parsed() {
+		if *listTransactionsAddress == "" || *listTransactionsCount < 0 || *listTransactionsSkip < 0 {
+			listTransactionsCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.listTransactions(*listTransactionsAddress, *listTransactionsCount, *listTransactionsSkip)
+	}
+
+	if signMessageCmd.Parsed() {
+		if *signMessageAddress == "" {
+			signMessageCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.signMessage(*signMessageAddress, *signMessageMessage)
+	}
+
+	if verifyMessageCmd.Parsed() {
+		if *verifyMessageAddress == "" || *verifyMessageSignature == "" {
+			verifyMessageCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.verifyMessage(*verifyMessageAddress, *verifyMessageSignature, *verifyMessageMessage)
+	}
+
+	if hdSetupCmd.Parsed() {
+		cli.hdSetup(*hdSetupMnemonic)
+	}
+
+	if dumpMnemonicCmd.Parsed() {
+		cli.dumpMnemonic()
+	}
+
+	if rescanHDCmd.Parsed() {
+		cli.rescanHD()
 	}
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO()
 	}
+
+	if getTxOutSetInfoCmd.Parsed() {
+		cli.getTxOutSetInfo()
+	}
+
+	if migrateDBCmd.Parsed() {
+		cli.migrateDB(*migrateDBDryRun)
+	}
+
+	if txIndexCmd.Parsed() {
+		cli.buildIndex("txindex", *txIndexDrop)
+	}
+
+	if addrIndexCmd.Parsed() {
+		cli.buildIndex("addrindex", *addrIndexDrop)
+	}
+
+	if listUnspentCmd.Parsed() {
+		if *listUnspentAddress == "" {
+			listUnspentCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.listUnspent(*listUnspentAddress)
+	}
+
+	if addressHistoryCmd.Parsed() {
+		if *addressHistoryAddress == "" {
+			addressHistoryCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.addressHistory(*addressHistoryAddress)
+	}
+
+	if getBlockCmd.Parsed() {
+		if *getBlockHash == "" {
+			getBlockCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getBlock(*getBlockHash)
+	}
+
+	if disconnectBlocksCmd.Parsed() {
+		if *disconnectBlocksCount <= 0 {
+			disconnectBlocksCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.disconnectBlocks(*disconnectBlocksCount)
+	}
+
+	if pruneCmd.Parsed() {
+		if *pruneDepth == 0 {
+			pruneCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.prune(*pruneDepth)
+	}
+
+	if verifyChainCmd.Parsed() {
+		if *verifyChainLevel < blockchain.VerifyHeaders || *verifyChainLevel > blockchain.VerifyUTXO {
+			verifyChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.verifyChain(*verifyChainDepth, *verifyChainLevel)
+	}
+
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOFile == "" {
+			dumpUTXOCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.dumpUTXO(*dumpUTXOFile)
+	}
+
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOFile == "" {
+			loadUTXOCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.loadUTXO(*loadUTXOFile, *loadUTXOHash, *loadUTXOBlocks)
+	}
+
+	if backfillCmd.Parsed() {
+		if *backfillBlocks == "" {
+			backfillCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.backfill(*backfillBlocks)
+	}
+
+	if backfillWorkerCmd.Parsed() {
+		cli.runBackfill(*backfillWorkerBlocks)
+	}
+
+	if exportChainCmd.Parsed() {
+		if *exportChainFile == "" {
+			exportChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.exportChain(*exportChainFile, *exportChainGzip)
+	}
+
+	if importChainCmd.Parsed() {
+		if *importChainFile == "" {
+			importChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importChain(*importChainFile)
+	}
+
+	if notarizeCmd.Parsed() {
+		if *notarizeFile == "" || *notarizeAddress == "" {
+			notarizeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.notarize(*notarizeFile, *notarizeAddress)
+	}
+
+	if verifyNotaryCmd.Parsed() {
+		if *verifyNotaryFile == "" {
+			verifyNotaryCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.verifyNotary(*verifyNotaryFile)
+	}
+
+	if voteCmd.Parsed() {
+		if *voteAddress == "" || *voteSigner == "" {
+			voteCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.vote(*voteAddress, *voteSigner, !*voteRemove)
+	}
 }
@@ -9,5 +9,6 @@ require (
 	github.com/golang/protobuf v1.2.0 // indirect
 	github.com/mr-tron/base58 v1.1.3
 	github.com/pkg/errors v0.8.0 // indirect
-	golang.org/x/crypto v0.0.0-20200414173820-0848c9571904
+	github.com/tyler-smith/go-bip39 v1.1.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,132 @@
+package wallet
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/mr-tron/base58"
+)
+
+//Addresses come in two formats, both carrying the 20 byte public key hash:
+//Base58Check with a version byte, and Bech32 with a human readable prefix
+//and a witness version 0 program. Each network has its own version byte
+//and prefix so coins can't be sent across networks by mistake.
+type Network struct {
+	Name    string
+	Version byte   //Base58Check version byte
+	HRP     string //Bech32 human readable prefix
+}
+
+var (
+	MainNet = Network{"main", 0x00, "blk"}
+	TestNet = Network{"test", 0x6f, "tblk"}
+	RegTest = Network{"regtest", 0x7a, "rblk"}
+
+	networks = []Network{MainNet, TestNet, RegTest}
+)
+
+//network addresses are encoded for and validated against
+var ActiveNetwork = MainNet
+
+const (
+	//length of the hash outputs are locked to
+	PubKeyHashLen = 20
+	//witness version of public key hash programs
+	witnessVersion = 0
+)
+
+func SetNetwork(name string) error {
+	for _, network := range networks {
+		if network.Name == name {
+			ActiveNetwork = network
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown network %q", name)
+}
+
+//Base58Check address of a public key hash
+func Base58Address(pubKeyHash []byte) string {
+	versionHash := append([]byte{ActiveNetwork.Version}, pubKeyHash...)
+	return string(Base58Encode(append(versionHash, CheckSum(versionHash)...)))
+}
+
+//Bech32 address of a public key hash
+func Bech32Address(pubKeyHash []byte) (string, error) {
+	program, err := convertBits(pubKeyHash, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	data := append([]byte{witnessVersion}, program...)
+	return Bech32Encode(ActiveNetwork.HRP, data, Bech32)
+}
+
+//public key hash of an address in either format, checking its checksum,
+//network, version and length
+func AddressPubKeyHash(address string) ([]byte, error) {
+	for _, network := range networks {
+		if strings.HasPrefix(strings.ToLower(address), network.HRP+"1") {
+			return decodeBech32Address(address)
+		}
+	}
+	return decodeBase58Address(address)
+}
+
+//Base58Check form of a valid address, wallets are keyed by it
+func canonicalAddress(address string) string {
+	pubKeyHash, err := AddressPubKeyHash(address)
+	if err != nil {
+		return address
+	}
+	return Base58Address(pubKeyHash)
+}
+
+func decodeBase58Address(address string) ([]byte, error) {
+	decoded, err := base58.Decode(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed base58", ErrInvalidAddress)
+	}
+	if len(decoded) != 1+PubKeyHashLen+checksumlen {
+		return nil, fmt.Errorf("%w: wrong length", ErrInvalidAddress)
+	}
+	payload := decoded[:len(decoded)-checksumlen]
+	if !bytes.Equal(CheckSum(payload), decoded[len(decoded)-checksumlen:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidAddress)
+	}
+	if payload[0] != ActiveNetwork.Version {
+		return nil, fmt.Errorf("%w: version %#x is not a %s network address", ErrInvalidAddress, payload[0], ActiveNetwork.Name)
+	}
+	return payload[1:], nil
+}
+
+func decodeBech32Address(address string) ([]byte, error) {
+	hrp, data, variant, err := Bech32Decode(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	if hrp != ActiveNetwork.HRP {
+		return nil, fmt.Errorf("%w: prefix %q is not a %s network address", ErrInvalidAddress, hrp, ActiveNetwork.Name)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: missing witness version", ErrInvalidAddress)
+	}
+	version := data[0]
+	switch {
+	case version > 16:
+		return nil, fmt.Errorf("%w: invalid witness version %d", ErrInvalidAddress, version)
+	case version == 0 && variant != Bech32, version != 0 && variant != Bech32m:
+		//BIP350, version 0 uses Bech32 and later versions Bech32m
+		return nil, fmt.Errorf("%w: wrong checksum variant for witness version %d", ErrInvalidAddress, version)
+	case version != witnessVersion:
+		return nil, fmt.Errorf("%w: unsupported witness version %d", ErrInvalidAddress, version)
+	}
+	program, err := convertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	if len(program) != PubKeyHashLen {
+		return nil, fmt.Errorf("%w: wrong program length", ErrInvalidAddress)
+	}
+	return program, nil
+}
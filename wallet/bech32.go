@@ -0,0 +1,156 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Bech32 (BIP173) and Bech32m (BIP350) encodings. They only differ in the
+//constant the checksum is xored with; witness version 0 uses Bech32 and
+//later versions Bech32m.
+const (
+	bech32Charset     = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	bech32Const       = 1
+	bech32mConst      = 0x2bc830a3
+	bech32MaxLength   = 90
+	bech32ChecksumLen = 6
+)
+
+type Bech32Variant int
+
+const (
+	Bech32 Bech32Variant = iota
+	Bech32m
+)
+
+func (v Bech32Variant) constant() uint32 {
+	if v == Bech32m {
+		return bech32mConst
+	}
+	return bech32Const
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	expanded := make([]byte, 0, 2*len(hrp)+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+func bech32Checksum(hrp string, data []byte, variant Bech32Variant) []byte {
+	values := append(bech32HRPExpand(hrp), data...)
+	values = append(values, make([]byte, bech32ChecksumLen)...)
+	mod := bech32Polymod(values) ^ variant.constant()
+
+	checksum := make([]byte, bech32ChecksumLen)
+	for i := range checksum {
+		checksum[i] = byte(mod>>uint(5*(5-i))) & 31
+	}
+	return checksum
+}
+
+//encode 5 bit groups data under hrp
+func Bech32Encode(hrp string, data []byte, variant Bech32Variant) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range append(data, bech32Checksum(hrp, data, variant)...) {
+		if v >= 32 {
+			return "", errors.New("bech32 data must be 5 bit groups")
+		}
+		sb.WriteByte(bech32Charset[v])
+	}
+	if sb.Len() > bech32MaxLength {
+		return "", errors.New("bech32 string is too long")
+	}
+	return sb.String(), nil
+}
+
+//decode a Bech32 or Bech32m string into its hrp and 5 bit groups
+func Bech32Decode(s string) (string, []byte, Bech32Variant, error) {
+	if len(s) > bech32MaxLength {
+		return "", nil, 0, errors.New("bech32 string is too long")
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, 0, errors.New("bech32 string mixes upper and lower case")
+	}
+	s = strings.ToLower(s)
+
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+bech32ChecksumLen+1 > len(s) {
+		return "", nil, 0, errors.New("bech32 separator misplaced")
+	}
+	hrp := s[:sep]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, 0, errors.New("bech32 prefix has an invalid character")
+		}
+	}
+
+	data := make([]byte, 0, len(s)-sep-1)
+	for _, c := range s[sep+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return "", nil, 0, fmt.Errorf("bech32 string has an invalid character %q", c)
+		}
+		data = append(data, byte(v))
+	}
+
+	var variant Bech32Variant
+	switch bech32Polymod(append(bech32HRPExpand(hrp), data...)) {
+	case bech32Const:
+		variant = Bech32
+	case bech32mConst:
+		variant = Bech32m
+	default:
+		return "", nil, 0, errors.New("bech32 checksum mismatch")
+	}
+	return hrp, data[:len(data)-bech32ChecksumLen], variant, nil
+}
+
+//regroup bits, e.g. bytes into the 5 bit groups of Bech32
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<to - 1
+	var out []byte
+	for _, v := range data {
+		if uint32(v)>>from != 0 {
+			return nil, errors.New("invalid data for bit conversion")
+		}
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding in bech32 data")
+	}
+	return out, nil
+}
@@ -0,0 +1,208 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+//valid checksums of BIP173 and BIP350
+var bech32Valid = []struct {
+	s       string
+	variant Bech32Variant
+}{
+	{"A12UEL5L", Bech32},
+	{"a12uel5l", Bech32},
+	{"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs", Bech32},
+	{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", Bech32},
+	{"11" + strings.Repeat("q", 82) + "c8247j", Bech32},
+	{"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w", Bech32},
+	{"?1ezyfcl", Bech32},
+	{"A1LQFN3A", Bech32m},
+	{"a1lqfn3a", Bech32m},
+	{"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6", Bech32m},
+	{"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx", Bech32m},
+	{"11" + strings.Repeat("l", 83) + "udsr8", Bech32m},
+	{"split1checkupstagehandshakeupstreamerranterredcaperredlc445v", Bech32m},
+	{"?1v759aa", Bech32m},
+}
+
+func TestBech32Valid(t *testing.T) {
+	for _, vector := range bech32Valid {
+		hrp, data, variant, err := Bech32Decode(vector.s)
+		if err != nil {
+			t.Errorf("%s: %v", vector.s, err)
+			continue
+		}
+		if variant != vector.variant {
+			t.Errorf("%s: variant %d, want %d", vector.s, variant, vector.variant)
+		}
+		encoded, err := Bech32Encode(hrp, data, variant)
+		if err != nil {
+			t.Errorf("%s: %v", vector.s, err)
+		}
+		if encoded != strings.ToLower(vector.s) {
+			t.Errorf("%s: encoded again as %s", vector.s, encoded)
+		}
+	}
+}
+
+func TestBech32Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{"prefix character out of range", "\x201nwldj5"},
+		{"prefix character out of range", "\x7f1axkwrx"},
+		{"prefix character out of range", "\x801eym55h"},
+		{"too long", "an84characterslonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1569pvx"},
+		{"no separator", "pzry9x0s0muk"},
+		{"empty prefix", "1pzry9x0s0muk"},
+		{"invalid data character", "x1b4n0q5v"},
+		{"checksum too short", "li1dgmt3"},
+		{"invalid checksum character", "de1lg7wt\xff"},
+		{"checksum of the upper case prefix", "A1G7SGD8"},
+		{"empty prefix", "10a06t8"},
+		{"empty prefix", "1qzzfhee"},
+		{"mixed case", "a12UEL5L"},
+		{"mixed case", "A1lqfn3a"},
+		{"bad checksum", "a12uel5m"},
+		{"bad checksum", "abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryy"},
+	}
+	for _, test := range tests {
+		if _, _, _, err := Bech32Decode(test.s); err == nil {
+			t.Errorf("%s: %q decoded", test.name, test.s)
+		}
+	}
+}
+
+func withNetwork(t *testing.T, network Network) {
+	active := ActiveNetwork
+	ActiveNetwork = network
+	t.Cleanup(func() { ActiveNetwork = active })
+}
+
+func TestBech32AddressVector(t *testing.T) {
+	withNetwork(t, Network{"bip173", 0x00, "bc"})
+	want, _ := hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+
+	for _, address := range []string{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"} {
+		//bc isn't a prefix of the known networks, decode it as Bech32 directly
+		pubKeyHash, err := decodeBech32Address(address)
+		if err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+		if !bytes.Equal(pubKeyHash, want) {
+			t.Errorf("%s: public key hash %x, want %x", address, pubKeyHash, want)
+		}
+	}
+	address, err := Bech32Address(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" {
+		t.Errorf("address %s", address)
+	}
+}
+
+//address of the active network with a witness version and 5 bit program
+func bech32TestAddress(t *testing.T, version byte, program []byte, variant Bech32Variant) string {
+	address, err := Bech32Encode(ActiveNetwork.HRP, append([]byte{version}, program...), variant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+func TestBech32AddressInvalid(t *testing.T) {
+	pubKeyHash := make([]byte, PubKeyHashLen)
+	rand.Read(pubKeyHash)
+	program, err := convertBits(pubKeyHash, 8, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := bech32TestAddress(t, 0, program, Bech32)
+	if _, err := AddressPubKeyHash(valid); err != nil {
+		t.Fatalf("%s: %v", valid, err)
+	}
+
+	//an extra zero group leaves 5 bits of padding, more than a byte allows
+	extraGroup := append(append([]byte{}, program...), 0)
+	short, err := convertBits(pubKeyHash[:19], 8, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//19 bytes leave 3 bits of padding, which must be zero
+	nonZeroPadding := append([]byte{}, short...)
+	nonZeroPadding[len(nonZeroPadding)-1] |= 1
+
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{"version 0 with a Bech32m checksum", bech32TestAddress(t, 0, program, Bech32m)},
+		{"version 1 with a Bech32 checksum", bech32TestAddress(t, 1, program, Bech32)},
+		{"unsupported version 1", bech32TestAddress(t, 1, program, Bech32m)},
+		{"invalid version 17", bech32TestAddress(t, 17, program, Bech32m)},
+		{"too much padding", bech32TestAddress(t, 0, extraGroup, Bech32)},
+		{"non zero padding", bech32TestAddress(t, 0, nonZeroPadding, Bech32)},
+		{"19 byte program", bech32TestAddress(t, 0, short, Bech32)},
+		{"mixed case", strings.ToUpper(valid[:10]) + valid[10:]},
+		{"bad checksum", valid[:len(valid)-1] + string(bech32Charset[(strings.IndexByte(bech32Charset, valid[len(valid)-1])+1)%32])},
+	}
+	otherNetwork, err := Bech32Encode(TestNet.HRP, append([]byte{0}, program...), Bech32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests = append(tests, struct{ name, address string }{"other network", otherNetwork})
+	for _, test := range tests {
+		_, err := AddressPubKeyHash(test.address)
+		if !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("%s: %s gave %v", test.name, test.address, err)
+		}
+	}
+
+	//the padding itself is rejected, not just the program length
+	for _, groups := range [][]byte{extraGroup, nonZeroPadding} {
+		if _, err := convertBits(groups, 5, 8, false); err == nil {
+			t.Errorf("groups %x converted despite their padding", groups)
+		}
+	}
+}
+
+func TestAddressRoundTrip(t *testing.T) {
+	for _, network := range networks {
+		withNetwork(t, network)
+		w := MakeWallet()
+		pubKeyHash := PublicKeyHash(w.PublicKey)
+
+		base58Address := Base58Address(pubKeyHash)
+		if base58Address != string(w.Address()) {
+			t.Errorf("%s: Base58 address %s, wallet address %s", network.Name, base58Address, w.Address())
+		}
+		bech32Address, err := Bech32Address(pubKeyHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(bech32Address, network.HRP+"1") {
+			t.Errorf("%s: Bech32 address %s lacks the prefix %s", network.Name, bech32Address, network.HRP)
+		}
+
+		for _, address := range []string{base58Address, bech32Address, strings.ToUpper(bech32Address)} {
+			decoded, err := AddressPubKeyHash(address)
+			if err != nil {
+				t.Errorf("%s: %s: %v", network.Name, address, err)
+				continue
+			}
+			if !bytes.Equal(decoded, pubKeyHash) {
+				t.Errorf("%s: %s decoded to %x, want %x", network.Name, address, decoded, pubKeyHash)
+			}
+			if canonical := canonicalAddress(address); canonical != base58Address {
+				t.Errorf("%s: %s canonical form %s, want %s", network.Name, address, canonical, base58Address)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+//Command line invocations don't outlive a single command, so an unlocked
+//wallet is remembered across them by an agent process holding the derived
+//key (never the passphrase) in memory until it expires. Later commands ask
+//it for the key over a unix socket only the owner can open, the key is
+//never written to disk.
+//The socket sits in a directory only the owner can enter, so nobody can
+//connect in the moment between it being created and its mode restricted.
+const (
+	agentDir    = "./tmp/agent"
+	agentSocket = agentDir + "/Wallets.sock"
+)
+
+//hidden command the agent process is started with, see RunAgent
+const AgentCommand = "walletagent"
+
+//session file of older versions, which kept the key on disk
+const legacyUnlockFile = "./tmp/Wallets.unlock"
+
+//scrypt parameters for deriving the AES-256 key from the passphrase
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	keyLen  = 32
+	saltLen = 16
+)
+
+var ErrWrongPassphrase = errors.New("wrong wallet passphrase")
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLen)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keyLen)
+}
+
+//AES-GCM encrypt plaintext, the random nonce is prepended to the result
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted wallet data is truncated")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//keep the wallet unlocked for later commands until timeout passes, the
+//key is handed to an agent started from this executable
+func (ws *Wallets) StartSession(timeout time.Duration) error {
+	ws.mu.Lock()
+	key := ws.key
+	ws.mu.Unlock()
+	if key == nil {
+		return ErrWalletLocked
+	}
+	if err := EndSession(); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	agent := exec.Command(exe, AgentCommand, "-timeout", strconv.Itoa(int(timeout/time.Second)))
+	agent.Stdin = bytes.NewReader(key)
+	ready, err := agent.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := agent.Start(); err != nil {
+		return err
+	}
+	//the agent closes its output once it is listening
+	if _, err := ioutil.ReadAll(ready); err != nil {
+		return err
+	}
+	if loadUnlockSession() == nil {
+		return errors.New("wallet agent didn't start")
+	}
+	return agent.Process.Release()
+}
+
+//serve the key read from stdin to later commands until timeout passes or
+//the session is ended, run by the process StartSession starts
+func RunAgent(timeout time.Duration) error {
+	key, err := ioutil.ReadAll(io.LimitReader(os.Stdin, keyLen+1))
+	if err != nil {
+		return err
+	}
+	if len(key) != keyLen {
+		return errors.New("invalid wallet key")
+	}
+
+	if err := os.MkdirAll(agentDir, 0700); err != nil {
+		return err
+	}
+	//MkdirAll leaves the mode of an existing directory alone
+	if err := os.Chmod(agentDir, 0700); err != nil {
+		return err
+	}
+	os.Remove(agentSocket)
+	listener, err := net.Listen("unix", agentSocket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(agentSocket, 0600); err != nil {
+		return err
+	}
+	os.Stdout.Close()
+
+	expired := time.AfterFunc(timeout, func() { listener.Close() })
+	defer expired.Stop()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			//closed by the timer or a lock request
+			return nil
+		}
+		if serveAgentRequest(conn, key) {
+			listener.Close()
+		}
+	}
+}
+
+//answer one request, returns whether the session was ended
+func serveAgentRequest(conn net.Conn, key []byte) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	request := make([]byte, 1)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return false
+	}
+	switch request[0] {
+	case 'k':
+		conn.Write(key)
+	case 'q':
+		return true
+	}
+	return false
+}
+
+//send request to the agent, an error means no session is running
+func agentRequest(request byte) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", agentSocket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte{request}); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.LimitReader(conn, keyLen))
+}
+
+//lock the wallet for later commands
+func EndSession() error {
+	if err := os.Remove(legacyUnlockFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := agentRequest('q'); err != nil {
+		//no agent, drop a socket left by one that was killed
+		if err := os.Remove(agentSocket); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//key held by a running agent
+func loadUnlockSession() []byte {
+	key, err := agentRequest('k')
+	if err != nil || len(key) != keyLen {
+		return nil
+	}
+	return key
+}
@@ -0,0 +1,289 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+//Hierarchical deterministic keys (BIP32) on the P-256 curve, following
+//SLIP-0010 which adapts BIP32 derivation to curves other than secp256k1.
+//Addresses live on m/44'/0'/0'/<chain>/<index>, chain 0 receives payments
+//and chain 1 holds change. Seeds are backed up as BIP39 mnemonics.
+const (
+	HardenedOffset = 0x80000000
+	AccountPath    = "m/44'/0'/0'"
+
+	ReceiveChain = 0
+	ChangeChain  = 1
+
+	//unused addresses in a row after which a rescan stops looking
+	GapLimit = 20
+
+	mnemonicEntropyBits = 256
+)
+
+//HMAC key for the master key of a P-256 seed, from SLIP-0010
+var masterKeySalt = []byte("Nist256p1 seed")
+
+var ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+type ExtendedKey struct {
+	Key       ecdsa.PrivateKey
+	ChainCode []byte
+}
+
+//new random mnemonic
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+//seed of a mnemonic, its checksum is verified
+func SeedFromMnemonic(mnemonic string) ([]byte, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return nil, ErrInvalidMnemonic
+	}
+	return seed, nil
+}
+
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	data := seed
+	for {
+		mac := hmac.New(sha512.New, masterKeySalt)
+		mac.Write(data)
+		I := mac.Sum(nil)
+		if key, ok := scalarKey(I[:32]); ok {
+			return &ExtendedKey{key, I[32:]}, nil
+		}
+		//invalid keys are retried with I as the new data
+		data = I
+	}
+}
+
+//derive child index, indexes from HardenedOffset on are hardened
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	var data []byte
+	if index >= HardenedOffset {
+		data = append([]byte{0x00}, scalarBytes(k.Key.D)...)
+	} else {
+		pub := k.Key.PublicKey
+		data = elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y)
+	}
+	data = append(data, uint32Bytes(index)...)
+
+	n := k.Key.Curve.Params().N
+	for {
+		mac := hmac.New(sha512.New, k.ChainCode)
+		mac.Write(data)
+		I := mac.Sum(nil)
+
+		il := new(big.Int).SetBytes(I[:32])
+		if il.Cmp(n) < 0 {
+			il.Add(il, k.Key.D)
+			il.Mod(il, n)
+			if key, ok := scalarKey(scalarBytes(il)); ok {
+				return &ExtendedKey{key, I[32:]}, nil
+			}
+		}
+		//SLIP-0010 retry for an invalid child
+		data = append(append([]byte{0x01}, I[32:]...), uint32Bytes(index)...)
+	}
+}
+
+//derive a path such as m/44'/0'/0'/0/1
+func (k *ExtendedKey) DerivePath(path string) (*ExtendedKey, error) {
+	parts := strings.Split(path, "/")
+	if parts[0] != "m" {
+		return nil, fmt.Errorf("derivation path %q must start with m", path)
+	}
+
+	key := k
+	for _, part := range parts[1:] {
+		offset := uint32(0)
+		if strings.HasSuffix(part, "'") {
+			offset = HardenedOffset
+			part = strings.TrimSuffix(part, "'")
+		}
+		index, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid derivation path %q", path)
+		}
+		key, err = key.Child(uint32(index) + offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+//path of an address on the account
+func AddressPath(chain, index uint32) string {
+	return fmt.Sprintf("%s/%d/%d", AccountPath, chain, index)
+}
+
+func scalarKey(d []byte) (ecdsa.PrivateKey, bool) {
+	n := elliptic.P256().Params().N
+	scalar := new(big.Int).SetBytes(d)
+	if scalar.Sign() == 0 || scalar.Cmp(n) >= 0 {
+		return ecdsa.PrivateKey{}, false
+	}
+	return privateKeyFromScalar(d), true
+}
+
+func scalarBytes(d *big.Int) []byte {
+	return d.FillBytes(make([]byte, coordLen))
+}
+
+func uint32Bytes(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	return buf
+}
+
+func (ws *Wallets) IsHD() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.hd
+}
+
+//give the wallet an HD seed, from mnemonic or a new one when it is empty
+//returns the mnemonic to back up
+func (ws *Wallets) InitHD(mnemonic string) (string, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.hd {
+		return "", ErrSeedExists
+	}
+	if ws.encrypted && ws.key == nil {
+		return "", ErrWalletLocked
+	}
+
+	if mnemonic == "" {
+		var err error
+		if mnemonic, err = NewMnemonic(); err != nil {
+			return "", err
+		}
+	}
+	if _, err := SeedFromMnemonic(mnemonic); err != nil {
+		return "", err
+	}
+	ws.hd = true
+	ws.mnemonic = mnemonic
+	ws.nextIndex = [2]uint32{}
+	return mnemonic, nil
+}
+
+//mnemonic backing up the HD seed
+func (ws *Wallets) Mnemonic() (string, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if !ws.hd {
+		return "", ErrNoSeed
+	}
+	if ws.mnemonic == "" {
+		return "", ErrWalletLocked
+	}
+	return ws.mnemonic, nil
+}
+
+//derive the next address of chain (ReceiveChain or ChangeChain)
+func (ws *Wallets) NewAddress(chain uint32) (string, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	account, err := ws.account()
+	if err != nil {
+		return "", err
+	}
+	address, err := ws.deriveAddress(account, chain, ws.nextIndex[chain])
+	if err != nil {
+		return "", err
+	}
+	ws.nextIndex[chain]++
+	return address, nil
+}
+
+//Derive addresses on both chains until GapLimit addresses in a row are
+//unused, adding every used one to the wallet. Used tells whether a public
+//key hash appears on the blockchain. Returns how many used addresses were found.
+func (ws *Wallets) DiscoverHD(used func(pubKeyHash []byte) bool) (int, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	account, err := ws.account()
+	if err != nil {
+		return 0, err
+	}
+	found := 0
+	for _, chain := range []uint32{ReceiveChain, ChangeChain} {
+		chainKey, err := account.Child(chain)
+		if err != nil {
+			return found, err
+		}
+		for index, gap := uint32(0), 0; gap < GapLimit; index++ {
+			key, err := chainKey.Child(index)
+			if err != nil {
+				return found, err
+			}
+			if !used(PublicKeyHash(PublicKeyBytes(&key.Key.PublicKey))) {
+				gap++
+				continue
+			}
+			gap = 0
+			found++
+			if index >= ws.nextIndex[chain] {
+				ws.nextIndex[chain] = index + 1
+			}
+			ws.addKey(key.Key, AddressPath(chain, index))
+		}
+	}
+	return found, nil
+}
+
+//derivation path of an HD address
+func (ws *Wallets) Path(address string) (string, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	path, ok := ws.paths[canonicalAddress(address)]
+	return path, ok
+}
+
+func (ws *Wallets) account() (*ExtendedKey, error) {
+	if !ws.hd {
+		return nil, ErrNoSeed
+	}
+	if ws.mnemonic == "" {
+		return nil, ErrWalletLocked
+	}
+	seed, err := SeedFromMnemonic(ws.mnemonic)
+	if err != nil {
+		return nil, err
+	}
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	return master.DerivePath(AccountPath)
+}
+
+func (ws *Wallets) deriveAddress(account *ExtendedKey, chain, index uint32) (string, error) {
+	key, err := account.DerivePath(fmt.Sprintf("m/%d/%d", chain, index))
+	if err != nil {
+		return "", err
+	}
+	return ws.addKey(key.Key, AddressPath(chain, index)), nil
+}
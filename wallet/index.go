@@ -0,0 +1,160 @@
+package wallet
+
+import (
+	"fmt"
+)
+
+//The wallet keeps its own index of the outputs paying its addresses and of
+//their transactions, so balances and histories don't need a chain scan.
+//Blocks are connected in chain order and disconnected from the top, which
+//undoes everything that happened at their height.
+
+//output paying a wallet address, owned or watched
+type OwnedOutput struct {
+	TxID        []byte
+	Index       int
+	Address     string
+	Value       int
+	Height      int
+	Spent       bool
+	SpentHeight int
+}
+
+//transaction of an address
+type TxRecord struct {
+	TxID      []byte
+	BlockHash []byte
+	Height    int
+	Received  int //paid by others
+	Sent      int //outputs of the address spent
+	Change    int //paid back to the wallet by its own spend
+	Fee       int //fee of a transaction the address paid for
+}
+
+//changes a block makes to the wallet, built by the blockchain package
+type BlockUpdate struct {
+	Hash    []byte
+	Created []OwnedOutput
+	Spent   []string //outpoints, see OutpointKey
+	Records map[string][]TxRecord
+}
+
+func OutpointKey(txID []byte, index int) string {
+	return fmt.Sprintf("%x:%d", txID, index)
+}
+
+//hashes of the blocks connected to the index, index is the height
+func (ws *Wallets) SyncedBlocks() [][]byte {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return append([][]byte(nil), ws.blocks...)
+}
+
+//height of the last connected block, -1 before genesis
+func (ws *Wallets) SyncedHeight() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.blocks) - 1
+}
+
+//connect the next block
+func (ws *Wallets) ConnectBlock(update BlockUpdate) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	height := len(ws.blocks)
+
+	for _, out := range update.Created {
+		out.Height = height
+		ws.outputs[OutpointKey(out.TxID, out.Index)] = out
+	}
+	for _, key := range update.Spent {
+		out, ok := ws.outputs[key]
+		if !ok {
+			continue
+		}
+		out.Spent = true
+		out.SpentHeight = height
+		ws.outputs[key] = out
+	}
+	for address, records := range update.Records {
+		for _, record := range records {
+			record.Height = height
+			record.BlockHash = update.Hash
+			ws.history[address] = append(ws.history[address], record)
+		}
+	}
+	ws.blocks = append(ws.blocks, update.Hash)
+}
+
+//disconnect blocks until height is the next one to connect
+func (ws *Wallets) Rollback(height int) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for len(ws.blocks) > height && len(ws.blocks) > 0 {
+		ws.disconnectBlock()
+	}
+}
+
+func (ws *Wallets) disconnectBlock() {
+	height := len(ws.blocks) - 1
+	if height < 0 {
+		return
+	}
+	for key, out := range ws.outputs {
+		switch {
+		case out.Height == height:
+			delete(ws.outputs, key)
+		case out.Spent && out.SpentHeight == height:
+			out.Spent = false
+			out.SpentHeight = 0
+			ws.outputs[key] = out
+		}
+	}
+	for address, history := range ws.history {
+		for len(history) > 0 && history[len(history)-1].Height == height {
+			history = history[:len(history)-1]
+		}
+		ws.history[address] = history
+	}
+	ws.blocks = ws.blocks[:height]
+}
+
+//indexed output, spent or not
+func (ws *Wallets) Output(txID []byte, index int) (OwnedOutput, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	out, ok := ws.outputs[OutpointKey(txID, index)]
+	return out, ok
+}
+
+//unspent outputs of address
+func (ws *Wallets) UnspentOutputs(address string) []OwnedOutput {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	var unspent []OwnedOutput
+	address = canonicalAddress(address)
+	for _, out := range ws.outputs {
+		if out.Address == address && !out.Spent {
+			unspent = append(unspent, out)
+		}
+	}
+	return unspent
+}
+
+func (ws *Wallets) Balance(address string) int {
+	balance := 0
+	for _, out := range ws.UnspentOutputs(address) {
+		balance += out.Value
+	}
+	return balance
+}
+
+//whether address is owned or watched by the wallet
+func (ws *Wallets) Tracks(address string) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	address = canonicalAddress(address)
+	_, owned := ws.Wallets[address]
+	_, watched := ws.watch[address]
+	return owned || watched
+}
@@ -0,0 +1,162 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mr-tron/base58"
+)
+
+//Private keys are exchanged like Bitcoin's WIF: a version byte, the 32 byte
+//scalar and a CheckSum, Base58 encoded.
+const privateKeyVersion = byte(0x80)
+
+//version of the JSON wallet backup
+const exportVersion = 1
+
+var ErrInvalidPrivateKey = errors.New("invalid private key")
+
+//JSON backup of a whole wallet
+type walletExport struct {
+	Version   int           `json:"version"`
+	Mnemonic  string        `json:"mnemonic,omitempty"`
+	NextIndex []uint32      `json:"nextIndex,omitempty"`
+	Keys      []exportedKey `json:"keys"`
+}
+
+type exportedKey struct {
+	Address    string `json:"address"`
+	PrivateKey string `json:"privateKey"`
+	Path       string `json:"path,omitempty"`
+}
+
+func EncodePrivateKey(key *ecdsa.PrivateKey) string {
+	payload := append([]byte{privateKeyVersion}, scalarBytes(key.D)...)
+	payload = append(payload, CheckSum(payload)...)
+	return string(Base58Encode(payload))
+}
+
+func DecodePrivateKey(encoded string) (ecdsa.PrivateKey, error) {
+	decoded, err := base58.Decode(encoded)
+	if err != nil || len(decoded) != 1+coordLen+checksumlen {
+		return ecdsa.PrivateKey{}, ErrInvalidPrivateKey
+	}
+	payload, checksum := decoded[:1+coordLen], decoded[1+coordLen:]
+	if payload[0] != privateKeyVersion || !bytes.Equal(CheckSum(payload), checksum) {
+		return ecdsa.PrivateKey{}, ErrInvalidPrivateKey
+	}
+	key, ok := scalarKey(payload[1:])
+	if !ok {
+		return ecdsa.PrivateKey{}, ErrInvalidPrivateKey
+	}
+	return key, nil
+}
+
+//encoded private key of address
+func (ws *Wallets) DumpPrivKey(address string) (string, error) {
+	key, err := ws.PrivateKey(address)
+	if err != nil {
+		return "", err
+	}
+	return EncodePrivateKey(&key), nil
+}
+
+//add the key encoded by DumpPrivKey, returns its address
+func (ws *Wallets) ImportPrivKey(encoded string) (string, error) {
+	key, err := DecodePrivateKey(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.encrypted && ws.key == nil {
+		return "", ErrWalletLocked
+	}
+	return ws.addKey(key, ""), nil
+}
+
+//JSON backup with every private key and the HD mnemonic, unencrypted
+func (ws *Wallets) Export() ([]byte, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.encrypted && ws.key == nil {
+		return nil, ErrWalletLocked
+	}
+
+	backup := walletExport{Version: exportVersion, Mnemonic: ws.mnemonic}
+	if ws.hd {
+		backup.NextIndex = ws.nextIndex[:]
+	}
+	for address, w := range ws.Wallets {
+		if w.PrivateKey.D == nil {
+			continue
+		}
+		key := exportedKey{address, EncodePrivateKey(&w.PrivateKey), ws.paths[address]}
+		backup.Keys = append(backup.Keys, key)
+	}
+	return json.MarshalIndent(backup, "", "  ")
+}
+
+//restore a backup made by Export, returns the imported addresses
+//the HD seed is only restored when the wallet doesn't have one
+func (ws *Wallets) Import(content []byte) ([]string, error) {
+	var backup walletExport
+	if err := json.Unmarshal(content, &backup); err != nil {
+		return nil, err
+	}
+	if backup.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported wallet backup version %d", backup.Version)
+	}
+	keys := make([]ecdsa.PrivateKey, len(backup.Keys))
+	for i, exported := range backup.Keys {
+		key, err := DecodePrivateKey(exported.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("key of %s: %v", exported.Address, err)
+		}
+		keys[i] = key
+	}
+	if backup.Mnemonic != "" {
+		if _, err := SeedFromMnemonic(backup.Mnemonic); err != nil {
+			return nil, err
+		}
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.encrypted && ws.key == nil {
+		return nil, ErrWalletLocked
+	}
+
+	restoreSeed := !ws.hd && backup.Mnemonic != ""
+	if restoreSeed {
+		ws.hd = true
+		ws.mnemonic = backup.Mnemonic
+		copy(ws.nextIndex[:], backup.NextIndex)
+	}
+	var addresses []string
+	for i, key := range keys {
+		path := ""
+		if restoreSeed {
+			path = backup.Keys[i].Path
+		}
+		addresses = append(addresses, ws.addKey(key, path))
+	}
+	return addresses, nil
+}
+
+//store key, path is its derivation path for HD keys
+func (ws *Wallets) addKey(key ecdsa.PrivateKey, path string) string {
+	w := Wallet{key, PublicKeyBytes(&key.PublicKey)}
+	address := string(w.Address())
+
+	ws.Wallets[address] = &w
+	delete(ws.watch, address)
+	if path != "" {
+		ws.paths[address] = path
+	}
+	return address
+}
@@ -0,0 +1,65 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+//Signed messages prove control of an address. The message is hashed with a
+//prefix so the signature can never pass as a transaction signature, and the
+//signature carries the public key since it can't be recovered from a P-256
+//ECDSA signature: base64(public key || DER signature).
+var messageMagic = []byte("Blockchain Signed Message:\n")
+
+var ErrInvalidMessageSignature = errors.New("invalid message signature")
+
+//double SHA-256 of the magic prefix and the length prefixed message
+func MessageHash(message string) []byte {
+	var buf bytes.Buffer
+	buf.Write(messageMagic)
+	length := make([]byte, binary.MaxVarintLen64)
+	buf.Write(length[:binary.PutUvarint(length, uint64(len(message)))])
+	buf.WriteString(message)
+
+	first := sha256.Sum256(buf.Bytes())
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+//sign message with the key of address
+func (ws *Wallets) SignMessage(address, message string) (string, error) {
+	key, err := ws.PrivateKey(address)
+	if err != nil {
+		return "", err
+	}
+	sig, err := Sign(&key, MessageHash(message))
+	if err != nil {
+		return "", err
+	}
+	payload := append(PublicKeyBytes(&key.PublicKey), sig...)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+//check a signature made by SignMessage against address
+func VerifyMessage(address, signature, message string) error {
+	pubKeyHash, err := AddressPubKeyHash(address)
+	if err != nil {
+		return err
+	}
+	payload, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(payload) <= PublicKeyLen {
+		return ErrInvalidMessageSignature
+	}
+	pubKey, sig := payload[:PublicKeyLen], payload[PublicKeyLen:]
+
+	if !bytes.Equal(PublicKeyHash(pubKey), pubKeyHash) {
+		return errors.New("signature was made by another address")
+	}
+	if !VerifySignature(pubKey, MessageHash(message), sig) {
+		return ErrInvalidMessageSignature
+	}
+	return nil
+}
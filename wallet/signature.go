@@ -0,0 +1,240 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+//width in bytes of each public key coordinate and of the private scalar
+const coordLen = 32
+
+//length of a public key encoded by PublicKeyBytes
+const PublicKeyLen = 2 * coordLen
+
+//ASN.1 layout of a DER encoded signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+//fixed width encoding of a public key, X and Y padded to 32 bytes each
+func PublicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	key := make([]byte, PublicKeyLen)
+	pub.X.FillBytes(key[:coordLen])
+	pub.Y.FillBytes(key[coordLen:])
+
+	return key
+}
+
+//decode a public key produced by PublicKeyBytes, or a shorter legacy key
+func ParsePublicKey(key []byte) (*ecdsa.PublicKey, error) {
+	if len(key) < PublicKeyLen {
+		return parseLegacyPublicKey(key)
+	}
+	if len(key) != PublicKeyLen {
+		return nil, errors.New("invalid public key length")
+	}
+	curve := elliptic.P256()
+	x := new(big.Int).SetBytes(key[:coordLen])
+	y := new(big.Int).SetBytes(key[coordLen:])
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("public key is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+//Older wallets wrote X.Bytes() and Y.Bytes() without padding, so a
+//coordinate with leading zero bytes made the key shorter. Every split
+//leaving both coordinates at most 32 bytes is tried and exactly one of
+//them must be a point on the curve.
+func parseLegacyPublicKey(key []byte) (*ecdsa.PublicKey, error) {
+	curve := elliptic.P256()
+	var pub *ecdsa.PublicKey
+	for _, split := range legacySplits(len(key)) {
+		x := new(big.Int).SetBytes(key[:split])
+		y := new(big.Int).SetBytes(key[split:])
+		if !curve.IsOnCurve(x, y) {
+			continue
+		}
+		if pub != nil {
+			return nil, errors.New("ambiguous legacy public key")
+		}
+		pub = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	}
+	if pub == nil {
+		return nil, errors.New("invalid public key")
+	}
+	return pub, nil
+}
+
+//positions splitting length bytes into two values of at most coordLen bytes
+func legacySplits(length int) []int {
+	var splits []int
+	for split := length - coordLen; split <= coordLen; split++ {
+		if split > 0 && split < length {
+			splits = append(splits, split)
+		}
+	}
+	return splits
+}
+
+//sign hash with a deterministic nonce (RFC 6979)
+//the signature is DER encoded and always has a low S value
+func Sign(priv *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	curve := priv.Curve
+	n := curve.Params().N
+	z := hashToInt(hash, n)
+
+	nonces := newNonceGenerator(priv.D, z, n)
+	for {
+		k := nonces.next()
+
+		x, _ := curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		s := new(big.Int).Mul(r, priv.D)
+		s.Add(s, z)
+		s.Mul(s, new(big.Int).ModInverse(k, n))
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+
+		//(r, s) and (r, n-s) are both valid, only accept the lower one
+		if s.Cmp(halfOrder(n)) > 0 {
+			s.Sub(n, s)
+		}
+		return asn1.Marshal(ecdsaSignature{r, s})
+	}
+}
+
+//verify a DER signature made by Sign against an encoded public key
+//non canonical encodings and high S values are rejected
+func VerifySignature(pubKey, hash, sig []byte) bool {
+	pub, err := ParsePublicKey(pubKey)
+	if err != nil {
+		return false
+	}
+	r, s, err := ParseSignature(sig)
+	if err != nil {
+		return false
+	}
+	if s.Cmp(halfOrder(pub.Curve.Params().N)) > 0 {
+		return false
+	}
+	return ecdsa.Verify(pub, hash, r, s)
+}
+
+//verify a signature of the legacy r||s form, r and s were written without
+//padding so every split is tried. Only transactions of legacy blocks hold
+//them, new signatures must be DER and pass VerifySignature
+func VerifyLegacySignature(pubKey, hash, sig []byte) bool {
+	pub, err := ParsePublicKey(pubKey)
+	if err != nil {
+		return false
+	}
+	for _, split := range legacySplits(len(sig)) {
+		r := new(big.Int).SetBytes(sig[:split])
+		s := new(big.Int).SetBytes(sig[split:])
+		if ecdsa.Verify(pub, hash, r, s) {
+			return true
+		}
+	}
+	return false
+}
+
+//decode a strict DER signature
+func ParseSignature(sig []byte) (*big.Int, *big.Int, error) {
+	var parsed ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) != 0 {
+		return nil, nil, errors.New("trailing data after signature")
+	}
+	if parsed.R.Sign() <= 0 || parsed.S.Sign() <= 0 {
+		return nil, nil, errors.New("signature values must be positive")
+	}
+	canonical, err := asn1.Marshal(parsed)
+	if err != nil || !bytes.Equal(canonical, sig) {
+		return nil, nil, errors.New("signature is not canonically encoded")
+	}
+	return parsed.R, parsed.S, nil
+}
+
+func halfOrder(n *big.Int) *big.Int {
+	return new(big.Int).Rsh(n, 1)
+}
+
+//bits2int from RFC 6979, reduced modulo n
+func hashToInt(hash []byte, n *big.Int) *big.Int {
+	orderBits := n.BitLen()
+	z := new(big.Int).SetBytes(hash)
+	if excess := len(hash)*8 - orderBits; excess > 0 {
+		z.Rsh(z, uint(excess))
+	}
+	return z.Mod(z, n)
+}
+
+//HMAC-SHA256 DRBG producing the nonces of RFC 6979 section 3.2
+type nonceGenerator struct {
+	k, v []byte
+	n    *big.Int
+	used bool
+}
+
+func newNonceGenerator(d, z, n *big.Int) *nonceGenerator {
+	x := make([]byte, coordLen)
+	d.FillBytes(x)
+	h := make([]byte, coordLen)
+	z.FillBytes(h)
+
+	gen := &nonceGenerator{
+		k: make([]byte, sha256.Size),
+		v: bytes.Repeat([]byte{0x01}, sha256.Size),
+		n: n,
+	}
+	gen.k = gen.mac(gen.v, []byte{0x00}, x, h)
+	gen.v = gen.mac(gen.v)
+	gen.k = gen.mac(gen.v, []byte{0x01}, x, h)
+	gen.v = gen.mac(gen.v)
+
+	return gen
+}
+
+func (gen *nonceGenerator) next() *big.Int {
+	for {
+		if gen.used {
+			gen.k = gen.mac(gen.v, []byte{0x00})
+			gen.v = gen.mac(gen.v)
+		}
+		gen.used = true
+
+		var t []byte
+		for len(t) < coordLen {
+			gen.v = gen.mac(gen.v)
+			t = append(t, gen.v...)
+		}
+		k := new(big.Int).SetBytes(t[:coordLen])
+		if k.Sign() > 0 && k.Cmp(gen.n) < 0 {
+			return k
+		}
+	}
+}
+
+func (gen *nonceGenerator) mac(data ...[]byte) []byte {
+	h := hmac.New(sha256.New, gen.k)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
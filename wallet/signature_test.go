@@ -0,0 +1,184 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func hexInt(t *testing.T, s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("bad hex %q", s)
+	}
+	return v
+}
+
+//RFC 6979 A.2.5, P-256 with SHA-256
+const rfc6979Key = "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721"
+
+var rfc6979Vectors = []struct {
+	message string
+	k, r, s string
+}{
+	{
+		"sample",
+		"A6E3C57DD01ABE90086538398355DD4C3B17AA873382B0F24D6129493D8AAD60",
+		"EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716",
+		"F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8",
+	},
+	{
+		"test",
+		"D16B6AE827F17175E040871A1C7EC3500192C4C92677336EC2537ACAEE0008E0",
+		"F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367",
+		"019F4113742A2B14BD25926B49C649155F267E60D3814B4C0CC84250E46F0083",
+	},
+}
+
+func rfc6979PrivateKey(t *testing.T) *ecdsa.PrivateKey {
+	d, err := hex.DecodeString(rfc6979Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := privateKeyFromScalar(d)
+	return &key
+}
+
+func TestNonceGeneratorRFC6979(t *testing.T) {
+	priv := rfc6979PrivateKey(t)
+	n := priv.Curve.Params().N
+	for _, vector := range rfc6979Vectors {
+		hash := sha256.Sum256([]byte(vector.message))
+		k := newNonceGenerator(priv.D, hashToInt(hash[:], n), n).next()
+		if k.Cmp(hexInt(t, vector.k)) != 0 {
+			t.Errorf("%s: nonce %X, want %s", vector.message, k, vector.k)
+		}
+	}
+}
+
+func TestSignRFC6979(t *testing.T) {
+	priv := rfc6979PrivateKey(t)
+	if priv.X.Cmp(hexInt(t, "60FED4BA255A9D31C961EB74C6356D68C049B8923B61FA6CE669622E60F29FB6")) != 0 ||
+		priv.Y.Cmp(hexInt(t, "7903FE1008B8BC99A41AE9E95628BC64F2F1B20C2D7E9F5177A3C294D4462299")) != 0 {
+		t.Fatal("public key doesn't match the test vector")
+	}
+	n := priv.Curve.Params().N
+	for _, vector := range rfc6979Vectors {
+		hash := sha256.Sum256([]byte(vector.message))
+		sig, err := Sign(priv, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, s, err := ParseSignature(sig)
+		if err != nil {
+			t.Fatalf("%s: %v", vector.message, err)
+		}
+
+		//Sign only produces the lower of s and n-s
+		want := hexInt(t, vector.s)
+		if want.Cmp(halfOrder(n)) > 0 {
+			want.Sub(n, want)
+		}
+		if r.Cmp(hexInt(t, vector.r)) != 0 || s.Cmp(want) != 0 {
+			t.Errorf("%s: signature (%X, %X), want (%s, %X)", vector.message, r, s, vector.r, want)
+		}
+		if !VerifySignature(PublicKeyBytes(&priv.PublicKey), hash[:], sig) {
+			t.Errorf("%s: signature doesn't verify", vector.message)
+		}
+	}
+}
+
+func TestVerifySignatureRejectsHighS(t *testing.T) {
+	priv := rfc6979PrivateKey(t)
+	hash := sha256.Sum256([]byte("sample"))
+	sig, err := Sign(priv, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ParseSignature(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//(r, n-s) is just as valid for ECDSA but malleates the signature
+	high, err := asn1.Marshal(ecdsaSignature{r, new(big.Int).Sub(priv.Curve.Params().N, s)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifySignature(PublicKeyBytes(&priv.PublicKey), hash[:], high) {
+		t.Error("high S signature verified")
+	}
+}
+
+func TestParseSignatureRejectsNonCanonical(t *testing.T) {
+	priv := rfc6979PrivateKey(t)
+	hash := sha256.Sum256([]byte("test"))
+	sig, err := Sign(priv, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseSignature(sig); err != nil {
+		t.Fatal(err)
+	}
+
+	//sig is SEQUENCE(0x30 len INTEGER(0x02 len r) INTEGER(0x02 len s))
+	rLen := int(sig[3])
+	padded := append([]byte{0x30, sig[1] + 1, 0x02, byte(rLen + 1), 0x00}, sig[4:]...)
+	longLength := append([]byte{0x30, 0x81, sig[1]}, sig[2:]...)
+	negative, err := asn1.Marshal(ecdsaSignature{big.NewInt(-1), big.NewInt(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		sig  []byte
+	}{
+		{"trailing data", append(append([]byte{}, sig...), 0x00)},
+		{"integer padded with a zero byte", padded},
+		{"long form length", longLength},
+		{"negative value", negative},
+		{"truncated", sig[:len(sig)-1]},
+		{"empty", nil},
+	}
+	for _, test := range tests {
+		if _, _, err := ParseSignature(test.sig); err == nil {
+			t.Errorf("%s: signature parsed", test.name)
+		}
+		if VerifySignature(PublicKeyBytes(&priv.PublicKey), hash[:], test.sig) {
+			t.Errorf("%s: signature verified", test.name)
+		}
+	}
+}
+
+func TestVerifyLegacySignature(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := PublicKeyBytes(&priv.PublicKey)
+	hash := sha256.Sum256([]byte("legacy"))
+
+	//legacy wallets signed with ecdsa.Sign and stored r.Bytes()||s.Bytes()
+	r, s, err := ecdsa.Sign(rand.Reader, priv, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.Bytes(), s.Bytes()...)
+
+	if !VerifyLegacySignature(pubKey, hash[:], sig) {
+		t.Error("legacy signature doesn't verify")
+	}
+	other := sha256.Sum256([]byte("other"))
+	if VerifyLegacySignature(pubKey, other[:], sig) {
+		t.Error("legacy signature verified for another hash")
+	}
+	if VerifySignature(pubKey, hash[:], sig) {
+		t.Error("legacy signature accepted as DER")
+	}
+}
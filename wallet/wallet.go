@@ -1,7 +1,6 @@
 package wallet
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -11,10 +10,7 @@ import (
 	"golang.org/x/crypto/ripemd160"
 )
 
-const (
-	checksumlen = 4
-	version     = byte(0x00)
-)
+const checksumlen = 4
 
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
@@ -29,7 +25,7 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Panic(err)
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pub := PublicKeyBytes(&private.PublicKey)
 	return *private, pub
 }
 
@@ -59,23 +55,14 @@ func CheckSum(payload []byte) []byte {
 	return secondHash[:checksumlen]
 }
 
+//Base58Check address of the wallet on the active network
 func (w Wallet) Address() []byte {
-	pubHash := PublicKeyHash(w.PublicKey)
-	versionHash := append([]byte{version}, pubHash...)
-	checksum := CheckSum(versionHash)
-
-	fullHash := append(versionHash, checksum...)
-	address := Base58Encode(fullHash)
-
-	return address
+	return []byte(Base58Address(PublicKeyHash(w.PublicKey)))
 }
 
+//whether address is a valid Base58Check or Bech32 address of the active
+//network, AddressPubKeyHash tells what is wrong with it
 func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualCheckSum := pubKeyHash[len(pubKeyHash)-checksumlen:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumlen]
-	targetCheckSum := CheckSum(append([]byte{version}, pubKeyHash...))
-
-	return bytes.Compare(actualCheckSum, targetCheckSum) == 0
+	_, err := AddressPubKeyHash(address)
+	return err == nil
 }
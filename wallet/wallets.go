@@ -2,33 +2,127 @@ package wallet
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
+	"sync"
+	"time"
 )
 
 const walletFile = "./tmp/Wallets.data"
 
+//version of the wallet file layout
+//version 2 added the HD seed to the private data
+const walletFileVersion = 2
+
+var (
+	ErrWalletLocked     = errors.New("wallet is locked, unlock it with walletpassphrase")
+	ErrUnknownAddress   = errors.New("address is not in the wallet")
+	ErrNotEncrypted     = errors.New("wallet is not encrypted")
+	ErrAlreadyEncrypted = errors.New("wallet is already encrypted")
+	ErrNoSeed           = errors.New("wallet has no HD seed, set one up with hdsetup")
+	ErrSeedExists       = errors.New("wallet already has an HD seed")
+)
+
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	mu        sync.Mutex
+	encrypted bool
+	salt      []byte //scrypt salt of the passphrase
+	sealed    []byte //encrypted private keys
+	key       []byte //key derived from the passphrase, only while unlocked
+	lockTimer *time.Timer
+	version   int //layout of the private data
+
+	hd        bool
+	mnemonic  string            //HD seed backup, only while unlocked
+	nextIndex [2]uint32         //next index of the receive and change chains
+	paths     map[string]string //derivation path of HD addresses
+
+	watch   map[string][]byte      //watch-only address -> public key if known
+	history map[string][]TxRecord  //address -> transactions
+	outputs map[string]OwnedOutput //outpoint -> output paying the wallet
+	blocks  [][]byte               //blocks connected to the index
+}
+
+//layout of the wallet file, private keys are sealed when Encrypted is set
+type walletFileData struct {
+	Version     int
+	PublicKeys  map[string][]byte //address -> public key
+	Encrypted   bool
+	Salt        []byte
+	PrivateKeys []byte //encoded by encodePrivateKeys
+
+	HD        bool
+	NextIndex []uint32
+	Paths     map[string]string
+
+	WatchOnly map[string][]byte
+	History   map[string][]TxRecord
+	Outputs   map[string]OwnedOutput
+	Blocks    [][]byte
+}
+
+//private part of the wallet file
+type privateData struct {
+	Keys     map[string][]byte //address -> private scalar
+	Mnemonic string
 }
 
 func (ws *Wallets) SaveFile() {
-	var content bytes.Buffer
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
 
-	gob.Register(elliptic.P256())
+	data := walletFileData{
+		PublicKeys: make(map[string][]byte),
+		Encrypted:  ws.encrypted,
+		Salt:       ws.salt,
+		HD:         ws.hd,
+		NextIndex:  ws.nextIndex[:],
+		Paths:      ws.paths,
+		WatchOnly:  ws.watch,
+		History:    ws.history,
+		Outputs:    ws.outputs,
+		Blocks:     ws.blocks,
+	}
+	for address, w := range ws.Wallets {
+		data.PublicKeys[address] = w.PublicKey
+	}
 
-	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
+	switch {
+	case !ws.encrypted:
+		data.PrivateKeys = ws.encodePrivateKeys()
+		ws.version = walletFileVersion
+	case ws.key != nil:
+		sealed, err := seal(ws.key, ws.encodePrivateKeys())
+		if err != nil {
+			log.Panic(err)
+		}
+		ws.sealed = sealed
+		data.PrivateKeys = sealed
+		ws.version = walletFileVersion
+	default:
+		//locked, keys can't change so keep the sealed copy in the
+		//layout it was written with
+		data.PrivateKeys = ws.sealed
+	}
+	data.Version = ws.version
 
+	var content bytes.Buffer
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(data)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = ioutil.WriteFile(walletFile, content.Bytes(), 0600)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -38,15 +132,59 @@ func (ws *Wallets) LoadFile() error {
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
-	var wallets Wallets
 	fileContent, err := ioutil.ReadFile(walletFile)
 	if err != nil {
 		return err
 	}
 
+	var data walletFileData
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&data)
+	if err != nil || data.Version == 0 {
+		return ws.loadLegacyFile(fileContent)
+	}
+
+	ws.Wallets = make(map[string]*Wallet)
+	for address, pub := range data.PublicKeys {
+		ws.Wallets[address] = &Wallet{PublicKey: pub}
+	}
+	ws.encrypted = data.Encrypted
+	ws.salt = data.Salt
+	ws.version = data.Version
+	ws.hd = data.HD
+	copy(ws.nextIndex[:], data.NextIndex)
+	if data.Paths != nil {
+		ws.paths = data.Paths
+	}
+	if data.WatchOnly != nil {
+		ws.watch = data.WatchOnly
+	}
+	if data.History != nil {
+		ws.history = data.History
+	}
+	if data.Outputs != nil {
+		ws.outputs = data.Outputs
+	}
+	ws.blocks = data.Blocks
+	if ws.encrypted {
+		ws.sealed = data.PrivateKeys
+		if key := loadUnlockSession(); key != nil && ws.unlockWithKey(key, 0) != nil {
+			//session of an older passphrase
+			EndSession()
+		}
+		return nil
+	}
+	return ws.decodePrivateKeys(data.PrivateKeys)
+}
+
+//files written before versioning gob encoded the Wallets struct itself
+func (ws *Wallets) loadLegacyFile(fileContent []byte) error {
+	var wallets struct {
+		Wallets map[string]*Wallet
+	}
 	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
+	err := decoder.Decode(&wallets)
 
 	if err != nil {
 		return err
@@ -58,14 +196,34 @@ func (ws *Wallets) LoadFile() error {
 func CreateWallets() (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.paths = make(map[string]string)
+	wallets.watch = make(map[string][]byte)
+	wallets.history = make(map[string][]TxRecord)
+	wallets.outputs = make(map[string]OwnedOutput)
+	wallets.version = walletFileVersion
 
 	err := wallets.LoadFile()
 
 	return &wallets, err
 }
 
-func (ws Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) Wallet {
+	return *ws.Wallets[canonicalAddress(address)]
+}
+
+//private key of address, fails while the wallet is locked
+func (ws *Wallets) PrivateKey(address string) (ecdsa.PrivateKey, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	w, ok := ws.Wallets[canonicalAddress(address)]
+	if !ok {
+		return ecdsa.PrivateKey{}, ErrUnknownAddress
+	}
+	if ws.encrypted && ws.key == nil {
+		return ecdsa.PrivateKey{}, ErrWalletLocked
+	}
+	return w.PrivateKey, nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
@@ -77,11 +235,161 @@ func (ws *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-func (ws *Wallets) AddWallet() string {
+//new keys of an encrypted wallet can only be stored while it is unlocked
+//HD wallets hand out the next receive address
+func (ws *Wallets) AddWallet() (string, error) {
+	if ws.IsLocked() {
+		return "", ErrWalletLocked
+	}
+	if ws.IsHD() {
+		return ws.NewAddress(ReceiveChain)
+	}
 	wallet := MakeWallet()
 	address := fmt.Sprintf("%s", wallet.Address())
 
+	ws.mu.Lock()
 	ws.Wallets[address] = wallet
+	ws.mu.Unlock()
+
+	return address, nil
+}
+
+func (ws *Wallets) IsEncrypted() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.encrypted
+}
+
+//encrypted and without the passphrase derived key in memory
+func (ws *Wallets) IsLocked() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.encrypted && ws.key == nil
+}
+
+//encrypt the private keys with passphrase, the wallet is left locked
+func (ws *Wallets) Encrypt(passphrase string) error {
+	ws.mu.Lock()
+	if ws.encrypted {
+		ws.mu.Unlock()
+		return ErrAlreadyEncrypted
+	}
+	salt, err := newSalt()
+	if err != nil {
+		ws.mu.Unlock()
+		return err
+	}
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		ws.mu.Unlock()
+		return err
+	}
+	ws.encrypted = true
+	ws.salt = salt
+	ws.key = key
+	ws.mu.Unlock()
+
+	ws.SaveFile()
+	ws.Lock()
+	return nil
+}
+
+//decrypt the private keys, relocking after timeout unless it is 0
+func (ws *Wallets) Unlock(passphrase string, timeout time.Duration) error {
+	if !ws.IsEncrypted() {
+		return ErrNotEncrypted
+	}
+	key, err := deriveKey(passphrase, ws.salt)
+	if err != nil {
+		return err
+	}
+	return ws.unlockWithKey(key, timeout)
+}
+
+func (ws *Wallets) unlockWithKey(key []byte, timeout time.Duration) error {
+	privateKeys, err := open(key, ws.sealed)
+	if err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err := ws.decodePrivateKeys(privateKeys); err != nil {
+		return err
+	}
+	ws.key = key
+	if ws.lockTimer != nil {
+		ws.lockTimer.Stop()
+	}
+	if timeout > 0 {
+		ws.lockTimer = time.AfterFunc(timeout, ws.Lock)
+	}
+	return nil
+}
+
+//forget the decrypted private keys of an encrypted wallet
+func (ws *Wallets) Lock() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if !ws.encrypted {
+		return
+	}
+	for _, w := range ws.Wallets {
+		w.PrivateKey = ecdsa.PrivateKey{}
+	}
+	ws.mnemonic = ""
+	ws.key = nil
+	if ws.lockTimer != nil {
+		ws.lockTimer.Stop()
+		ws.lockTimer = nil
+	}
+}
+
+//private scalars keyed by address and the HD mnemonic
+func (ws *Wallets) encodePrivateKeys() []byte {
+	data := privateData{Keys: make(map[string][]byte), Mnemonic: ws.mnemonic}
+	for address, w := range ws.Wallets {
+		if w.PrivateKey.D != nil {
+			data.Keys[address] = scalarBytes(w.PrivateKey.D)
+		}
+	}
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return content.Bytes()
+}
+
+func (ws *Wallets) decodePrivateKeys(content []byte) error {
+	var data privateData
+	decoder := gob.NewDecoder(bytes.NewReader(content))
+	var err error
+	if ws.version < 2 {
+		//version 1 only stored the keys
+		err = decoder.Decode(&data.Keys)
+	} else {
+		err = decoder.Decode(&data)
+	}
+	if err != nil {
+		return err
+	}
+
+	for address, d := range data.Keys {
+		w, ok := ws.Wallets[address]
+		if !ok {
+			continue
+		}
+		w.PrivateKey = privateKeyFromScalar(d)
+	}
+	ws.mnemonic = data.Mnemonic
+	return nil
+}
 
-	return address
+func privateKeyFromScalar(d []byte) ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	key := ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d)
+	return key
 }
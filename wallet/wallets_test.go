@@ -0,0 +1,106 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//run the test in a fresh directory, the wallet file lives under ./tmp
+func chdirTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveLockedVersion1File(t *testing.T) {
+	chdirTemp(t)
+	w := MakeWallet()
+	address := string(w.Address())
+
+	//version 1 sealed only the map of private scalars
+	salt, err := newSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := deriveKey("pw", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys bytes.Buffer
+	if err := gob.NewEncoder(&keys).Encode(map[string][]byte{address: scalarBytes(w.PrivateKey.D)}); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal(key, keys.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file bytes.Buffer
+	err = gob.NewEncoder(&file).Encode(walletFileData{
+		Version:     1,
+		PublicKeys:  map[string][]byte{address: w.PublicKey},
+		Encrypted:   true,
+		Salt:        salt,
+		PrivateKeys: sealed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(walletFile, file.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	wallets, err := CreateWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wallets.IsLocked() {
+		t.Fatal("loaded wallet is not locked")
+	}
+	wallets.SaveFile()
+
+	wallets, err = CreateWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wallets.Unlock("pw", 0); err != nil {
+		t.Fatalf("unlocking the saved wallet: %v", err)
+	}
+	privateKey, err := wallets.PrivateKey(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privateKey.D.Cmp(w.PrivateKey.D) != 0 {
+		t.Error("unlocked private key differs from the stored one")
+	}
+
+	//saving while unlocked rewrites the keys in the current layout
+	wallets.SaveFile()
+	wallets, err = CreateWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wallets.version != walletFileVersion {
+		t.Errorf("version %d after saving unlocked, want %d", wallets.version, walletFileVersion)
+	}
+	if err := wallets.Unlock("pw", 0); err != nil {
+		t.Fatalf("unlocking the rewritten wallet: %v", err)
+	}
+}
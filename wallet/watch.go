@@ -0,0 +1,92 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"errors"
+	"sort"
+)
+
+var (
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrKeyInWallet    = errors.New("address is already in the wallet with its private key")
+)
+
+//Watch-only entries track an address whose keys live elsewhere. They are
+//kept apart from Wallets so nothing tries to sign with them, the public key
+//is only known when one was imported.
+
+//watch address, or the address of a hex encoded public key
+func (ws *Wallets) ImportAddress(addressOrKey string) (string, error) {
+	address, pubKey, err := parseWatchEntry(addressOrKey)
+	if err != nil {
+		return "", err
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.Wallets[address]; ok {
+		return "", ErrKeyInWallet
+	}
+	if pubKey == nil {
+		//keep a public key imported before
+		pubKey = ws.watch[address]
+	}
+	ws.watch[address] = pubKey
+	return address, nil
+}
+
+func (ws *Wallets) IsWatchOnly(address string) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	_, ok := ws.watch[canonicalAddress(address)]
+	return ok
+}
+
+func (ws *Wallets) WatchOnlyAddresses() []string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	var addresses []string
+	for address := range ws.watch {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+//hex public key hash of every address the wallet tracks, owned or watched
+func (ws *Wallets) PubKeyHashes() map[string]string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	hashes := make(map[string]string)
+	for address, w := range ws.Wallets {
+		hashes[hex.EncodeToString(PublicKeyHash(w.PublicKey))] = address
+	}
+	for address := range ws.watch {
+		pubKeyHash, err := AddressPubKeyHash(address)
+		if err == nil {
+			hashes[hex.EncodeToString(pubKeyHash)] = address
+		}
+	}
+	return hashes
+}
+
+//transactions of address, oldest first
+func (ws *Wallets) History(address string) []TxRecord {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return append([]TxRecord(nil), ws.history[canonicalAddress(address)]...)
+}
+
+func parseWatchEntry(addressOrKey string) (string, []byte, error) {
+	if pubKeyHash, err := AddressPubKeyHash(addressOrKey); err == nil {
+		return Base58Address(pubKeyHash), nil, nil
+	}
+	pubKey, err := hex.DecodeString(addressOrKey)
+	if err != nil {
+		return "", nil, ErrInvalidAddress
+	}
+	if _, err := ParsePublicKey(pubKey); err != nil {
+		return "", nil, err
+	}
+	return string(Wallet{PublicKey: pubKey}.Address()), pubKey, nil
+}